@@ -2,19 +2,33 @@ package resource_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"log"
 	"net/http"
+	"net/http/httptest"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
@@ -1570,6 +1584,85 @@ var _ = DescribeTable("tracking semver tags",
 			},
 		},
 	),
+	Entry("tag exclude regex",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.1.0",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "1.2.0",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "latest",
+					ImageName: "random-4",
+				},
+			},
+			TagExcludeRegex: `^1\.1\.`,
+			Versions:        []string{"1.0.0", "1.2.0", "latest"},
+		},
+	),
+	Entry("tag include regex",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "2.0.0",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "2.1.0",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "latest",
+					ImageName: "random-4",
+				},
+			},
+			TagIncludeRegex: `^2\.`,
+			Versions:        []string{"2.0.0", "2.1.0", "latest"},
+		},
+	),
+	Entry("tag include and exclude regex with pre-releases",
+		SemverOrRegexTagCheckExample{
+			Tags: []testTag{
+				{
+					Tag:       "1.0.0",
+					ImageName: "random-1",
+				},
+				{
+					Tag:       "1.1.0-rc.1",
+					ImageName: "random-2",
+				},
+				{
+					Tag:       "1.1.0-rc.1-debug",
+					ImageName: "random-3",
+				},
+				{
+					Tag:       "1.1.0-rc.1-windowsservercore",
+					ImageName: "random-4",
+				},
+				{
+					Tag:       "2.0.0",
+					ImageName: "random-5",
+				},
+			},
+			PreReleases:        true,
+			PreReleasePrefixes: []string{"rc"},
+			TagIncludeRegex:    `^1\.`,
+			TagExcludeRegex:    `-(debug|windowsservercore)$`,
+			Versions:           []string{"1.0.0", "1.1.0-rc.1"},
+		},
+	),
 	Entry("tries mirror and falls back on original repository",
 		SemverOrRegexTagCheckExample{
 			Tags: []testTag{
@@ -1635,6 +1728,9 @@ type SemverOrRegexTagCheckExample struct {
 
 	SemverConstraint string
 
+	TagIncludeRegex string
+	TagExcludeRegex string
+
 	Repository     string
 	RegistryMirror string
 	WorkingMirror  bool
@@ -1672,6 +1768,8 @@ func (example SemverOrRegexTagCheckExample) Run() {
 			PreReleasePrefixes: example.PreReleasePrefixes,
 			Variant:            example.Variant,
 			SemverConstraint:   example.SemverConstraint,
+			TagIncludeRegex:    example.TagIncludeRegex,
+			TagExcludeRegex:    example.TagExcludeRegex,
 			Regex:              example.Regex,
 			CreatedAtSort:      example.CreatedAtSort,
 		},
@@ -1846,3 +1944,1313 @@ func (example SemverOrRegexTagCheckExample) check(req resource.CheckRequest) res
 
 	return res
 }
+
+var _ = Describe("checking multiple repositories", func() {
+	var registryServer *httptest.Server
+	var req resource.CheckRequest
+
+	var current, legacy string
+
+	BeforeEach(func() {
+		registryServer = newTestRegistry()
+
+		current = registryServer.Listener.Addr().String() + "/org/app"
+		legacy = registryServer.Listener.Addr().String() + "/org/app-server"
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository:   current,
+				Repositories: []string{legacy},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		registryServer.Close()
+	})
+
+	It("merges the semver tags of each repository into one stream", func() {
+		legacy100 := pushRandomImage(legacy + ":1.0.0")
+		legacy110 := pushRandomImage(legacy + ":1.1.0")
+		current120 := pushRandomImage(current + ":1.2.0")
+		current111 := pushRandomImage(current + ":1.1.1")
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(legacy100), Repository: legacy},
+			{Tag: "1.1.0", Digest: imageDigest(legacy110), Repository: legacy},
+			{Tag: "1.1.1", Digest: imageDigest(current111), Repository: current},
+			{Tag: "1.2.0", Digest: imageDigest(current120), Repository: current},
+		}))
+	})
+
+	It("only emits images published to more than one repository once", func() {
+		image := pushRandomImage(current + ":1.0.0")
+		pushImage(legacy+":1.0.0", image)
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(image), Repository: current},
+		}))
+	})
+
+	It("emits only the latest tag of the first repository", func() {
+		current100 := pushRandomImage(current + ":1.0.0")
+		currentLatest := pushRandomImage(current + ":latest")
+		pushRandomImage(legacy + ":latest")
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(current100), Repository: current},
+			{Tag: "latest", Digest: imageDigest(currentLatest), Repository: current},
+		}))
+	})
+
+	Context("when invoked with a cursor version", func() {
+		var current111, current120 v1.Image
+
+		BeforeEach(func() {
+			pushRandomImage(legacy + ":1.0.0")
+			pushRandomImage(legacy + ":1.1.0")
+			current111 = pushRandomImage(current + ":1.1.1")
+			current120 = pushRandomImage(current + ":1.2.0")
+
+			req.Version = &resource.Version{
+				Tag:        "1.1.1",
+				Digest:     imageDigest(current111),
+				Repository: current,
+			}
+		})
+
+		It("returns the cursor version and the versions after it", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.1.1", Digest: imageDigest(current111), Repository: current},
+				{Tag: "1.2.0", Digest: imageDigest(current120), Repository: current},
+			}))
+		})
+
+		It("returns the newer versions of the other repositories", func() {
+			legacy130 := pushRandomImage(legacy + ":1.3.0")
+
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.1.1", Digest: imageDigest(current111), Repository: current},
+				{Tag: "1.2.0", Digest: imageDigest(current120), Repository: current},
+				{Tag: "1.3.0", Digest: imageDigest(legacy130), Repository: legacy},
+			}))
+		})
+	})
+
+	Context("when filtering by age with a cursor version", func() {
+		var current111, legacy120 v1.Image
+
+		BeforeEach(func() {
+			created := time.Now().Add(-7 * 24 * time.Hour)
+
+			legacy100 := pushCreatedAt(legacy+":1.0.0", created)
+			current111 = pushCreatedAt(current+":1.1.1", created)
+			legacy120 = pushCreatedAt(legacy+":1.2.0", created)
+
+			// the registry can no longer tell the age of the older version
+			config, err := legacy100.ConfigName()
+			Expect(err).ToNot(HaveOccurred())
+			deleteBlob, err := http.NewRequest(http.MethodDelete, registryServer.URL+"/v2/org/app-server/blobs/"+config.String(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			res, err := http.DefaultClient.Do(deleteBlob)
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusAccepted))
+
+			req.Source.MinAge = resource.Duration(24 * time.Hour)
+			req.Version = &resource.Version{
+				Tag:        "1.1.1",
+				Digest:     imageDigest(current111),
+				Repository: current,
+			}
+		})
+
+		It("only filters the versions after the cursor", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.1.1", Digest: imageDigest(current111), Repository: current},
+				{Tag: "1.2.0", Digest: imageDigest(legacy120), Repository: legacy},
+			}))
+		})
+	})
+
+	Context("when tracking the base image", func() {
+		BeforeEach(func() {
+			req.Source.TrackBaseImage = true
+		})
+
+		It("returns an error", func() {
+			_, err := runCheck(req)
+			Expect(err).To(MatchError(ContainSubstring("repositories can only be used when checking semver tags")))
+		})
+	})
+
+	Context("when checking referrers", func() {
+		BeforeEach(func() {
+			req.Source.ReferrersOf = &resource.ReferrersOf{Tag: "1.0.0"}
+		})
+
+		It("returns an error", func() {
+			_, err := runCheck(req)
+			Expect(err).To(MatchError(ContainSubstring("repositories can only be used when checking semver tags")))
+		})
+	})
+})
+
+var _ = Describe("checking with a minimum or maximum age", func() {
+	var registryServer *httptest.Server
+	var req resource.CheckRequest
+
+	var repo string
+	var old, settled, fresh v1.Image
+
+	BeforeEach(func() {
+		registryServer = newTestRegistry()
+
+		repo = registryServer.Listener.Addr().String() + "/test-image"
+
+		old = pushCreatedAt(repo+":1.0.0", time.Now().Add(-90*24*time.Hour))
+		settled = pushCreatedAt(repo+":1.1.0", time.Now().Add(-7*24*time.Hour))
+		fresh = pushCreatedAt(repo+":1.2.0", time.Now().Add(-time.Hour))
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository: repo,
+			},
+		}
+	})
+
+	AfterEach(func() {
+		registryServer.Close()
+	})
+
+	It("withholds versions newer than min_age", func() {
+		req.Source.MinAge = resource.Duration(72 * time.Hour)
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(old)},
+			{Tag: "1.1.0", Digest: imageDigest(settled)},
+		}))
+	})
+
+	It("skips versions older than max_age", func() {
+		req.Source.MaxAge = resource.Duration(30 * 24 * time.Hour)
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.1.0", Digest: imageDigest(settled)},
+			{Tag: "1.2.0", Digest: imageDigest(fresh)},
+		}))
+	})
+
+	Context("when an image was created at the epoch", func() {
+		BeforeEach(func() {
+			pushCreatedAt(repo+":1.3.0", time.Unix(0, 0))
+
+			req.Source.MinAge = resource.Duration(72 * time.Hour)
+			req.Source.MaxAge = resource.Duration(30 * 24 * time.Hour)
+		})
+
+		It("withholds it, as its age can't be told", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.1.0", Digest: imageDigest(settled)},
+			}))
+		})
+	})
+
+	Context("when tracking a single tag", func() {
+		BeforeEach(func() {
+			req.Source.Tag = "1.2.0"
+			req.Source.MinAge = resource.Duration(72 * time.Hour)
+		})
+
+		It("does not emit the tag until it is old enough", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("checking against multiple registry mirrors", func() {
+	var origin, firstMirror, secondMirror *httptest.Server
+	var req resource.CheckRequest
+
+	var image v1.Image
+
+	BeforeEach(func() {
+		origin = newTestRegistry()
+		firstMirror = newTestRegistry()
+		secondMirror = newTestRegistry()
+
+		// only the second mirror has the image; the origin is empty
+		image = pushRandomImage(secondMirror.Listener.Addr().String() + "/org/app:1.0.0")
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository: origin.Listener.Addr().String() + "/org/app",
+				RegistryMirrors: []resource.RegistryMirror{
+					{
+						Host:       firstMirror.Listener.Addr().String(),
+						Registries: []string{"127.0.0.1:*"},
+					},
+					{
+						Host:       secondMirror.Listener.Addr().String(),
+						Registries: []string{"127.0.0.1:*"},
+					},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		origin.Close()
+		firstMirror.Close()
+		secondMirror.Close()
+	})
+
+	It("tries each mirror in order", func() {
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(image)},
+		}))
+	})
+
+	Context("when the mirrors do not serve the repository's registry", func() {
+		BeforeEach(func() {
+			for i := range req.Source.RegistryMirrors {
+				req.Source.RegistryMirrors[i].Registries = []string{"ghcr.io", "*.gcr.io"}
+			}
+		})
+
+		It("only checks the origin", func() {
+			originImage := pushRandomImage(req.Source.Repository + ":2.0.0")
+
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "2.0.0", Digest: imageDigest(originImage)},
+			}))
+		})
+	})
+
+	Context("when a failing mirror is fatal", func() {
+		BeforeEach(func() {
+			req.Source.RegistryMirrors[0].Fatal = true
+		})
+
+		It("exits non-zero rather than trying the next mirror", func() {
+			_, err := runCheck(req)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("checking through registry rewrites", func() {
+	var proxy *httptest.Server
+	var req resource.CheckRequest
+
+	BeforeEach(func() {
+		proxy = newTestRegistry()
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository: "ghcr.io/org/app",
+				RegistryRewrites: []resource.RegistryRewrite{
+					{
+						Prefix:   "docker.io/",
+						Location: proxy.Listener.Addr().String() + "/dockerhub-proxy/",
+					},
+					{
+						Prefix:   "ghcr.io/",
+						Location: proxy.Listener.Addr().String() + "/ghcr-proxy/",
+					},
+					{
+						Prefix:   "ghcr.io/org/app",
+						Location: proxy.Listener.Addr().String() + "/app-proxy",
+					},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		proxy.Close()
+	})
+
+	It("checks the location of the longest matching prefix", func() {
+		image := pushRandomImage(proxy.Listener.Addr().String() + "/app-proxy:1.0.0")
+		pushRandomImage(proxy.Listener.Addr().String() + "/ghcr-proxy/org/app:2.0.0")
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(image)},
+		}))
+	})
+
+	It("rewrites Docker Hub repositories with their implicit namespace", func() {
+		req.Source.Repository = "alpine"
+
+		image := pushRandomImage(proxy.Listener.Addr().String() + "/dockerhub-proxy/library/alpine:3.20.0")
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "3.20.0", Digest: imageDigest(image)},
+		}))
+	})
+})
+
+var _ = Describe("verifying a mirror against the origin", func() {
+	var origin, mirror *httptest.Server
+	var req resource.CheckRequest
+
+	var mirrorImage v1.Image
+
+	BeforeEach(func() {
+		origin = newTestRegistry()
+		mirror = newTestRegistry()
+
+		mirrorImage = pushRandomImage(mirror.Listener.Addr().String() + "/org/app:1.0.0")
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository: origin.Listener.Addr().String() + "/org/app",
+				RegistryMirror: &resource.RegistryMirror{
+					Host:       mirror.Listener.Addr().String(),
+					Registries: []string{"127.0.0.1:*"},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		origin.Close()
+		mirror.Close()
+	})
+
+	Context("when the origin agrees with the mirror", func() {
+		BeforeEach(func() {
+			pushImage(origin.Listener.Addr().String()+"/org/app:1.0.0", mirrorImage)
+			req.Source.RegistryMirror.Verify = resource.MirrorVerifyFail
+		})
+
+		It("returns the mirror's versions", func() {
+			res, err := runCheck(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.0.0", Digest: imageDigest(mirrorImage)},
+			}))
+		})
+	})
+
+	Context("when the origin has a different digest for the newest version", func() {
+		var originImage v1.Image
+
+		BeforeEach(func() {
+			originImage = pushRandomImage(origin.Listener.Addr().String() + "/org/app:1.0.0")
+		})
+
+		It("returns the origin's versions with the warn policy", func() {
+			req.Source.RegistryMirror.Verify = resource.MirrorVerifyWarn
+
+			res, err := runCheck(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.0.0", Digest: imageDigest(originImage)},
+			}))
+		})
+
+		It("fails with the fail policy", func() {
+			req.Source.RegistryMirror.Verify = resource.MirrorVerifyFail
+
+			_, err := runCheck(req)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the origin cannot be reached", func() {
+		BeforeEach(func() {
+			origin.Close()
+		})
+
+		It("returns the mirror's versions with the warn policy", func() {
+			req.Source.RegistryMirror.Verify = resource.MirrorVerifyWarn
+
+			res, err := runCheck(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.0.0", Digest: imageDigest(mirrorImage)},
+			}))
+		})
+
+		It("fails with the fail policy", func() {
+			req.Source.RegistryMirror.Verify = resource.MirrorVerifyFail
+
+			_, err := runCheck(req)
+			Expect(err).To(MatchError(ContainSubstring("cannot verify mirror")))
+		})
+	})
+
+	Context("with an unknown policy", func() {
+		BeforeEach(func() {
+			req.Source.RegistryMirror.Verify = "sometimes"
+		})
+
+		It("fails", func() {
+			_, err := runCheck(req)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("checking with the ECR DescribeImages API", func() {
+	var registryServer *httptest.Server
+	var ecr *fakeECR
+	var req resource.CheckRequest
+
+	BeforeEach(func() {
+		// only used for the ping; tags and digests all come from the ECR API
+		registryServer = newTestRegistry()
+
+		ecr = newFakeECR("https://" + registryServer.Listener.Addr().String())
+
+		ecr.RespondTo("DescribeImages", map[string]any{
+			"imageDetails": []any{
+				map[string]any{
+					"imageDigest":   OLDER_FAKE_DIGEST,
+					"imageTags":     []string{"1.1.0", "build-b"},
+					"imagePushedAt": time.Now().Add(-7 * 24 * time.Hour).Unix(),
+				},
+				map[string]any{
+					"imageDigest":   LATEST_FAKE_DIGEST,
+					"imageTags":     []string{"1.0.0", "build-a"},
+					"imagePushedAt": time.Now().Add(-time.Hour).Unix(),
+				},
+			},
+		})
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository: "test-image",
+				AwsCredentials: resource.AwsCredentials{
+					AwsAccessKeyId:       "some-access-key",
+					AwsSecretAccessKey:   "some-secret-key",
+					AwsRegion:            "us-east-1",
+					AwsEcrEndpoint:       ecr.URL,
+					AwsEcrDescribeImages: true,
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		ecr.Close()
+		registryServer.Close()
+	})
+
+	It("lists semver tags with their digests", func() {
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: LATEST_FAKE_DIGEST},
+			{Tag: "1.1.0", Digest: OLDER_FAKE_DIGEST},
+		}))
+
+		Expect(ecr.Requests("DescribeImages")).To(ConsistOf(And(
+			HaveKeyWithValue("repositoryName", "test-image"),
+			HaveKeyWithValue("filter", HaveKeyWithValue("tagStatus", "TAGGED")),
+		)))
+	})
+
+	It("sorts regex matches by push time", func() {
+		req.Source.Regex = "build-.*"
+		req.Source.PushedAtSort = true
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "build-b", Digest: OLDER_FAKE_DIGEST},
+			{Tag: "build-a", Digest: LATEST_FAKE_DIGEST},
+		}))
+	})
+
+	It("uses the push time for min_age", func() {
+		req.Source.MinAge = resource.Duration(24 * time.Hour)
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.1.0", Digest: OLDER_FAKE_DIGEST},
+		}))
+	})
+
+	It("fails without an aws_region", func() {
+		req.Source.AwsRegion = ""
+
+		_, err := runCheck(req)
+		Expect(err).To(MatchError(ContainSubstring("aws_ecr_describe_images is only supported for ECR repositories")))
+	})
+
+	It("follows pagination", func() {
+		ecr.RespondTo("DescribeImages", func(input map[string]any) any {
+			if input["nextToken"] == nil {
+				return map[string]any{
+					"imageDetails": []any{
+						map[string]any{
+							"imageDigest":   OLDER_FAKE_DIGEST,
+							"imageTags":     []string{"1.1.0"},
+							"imagePushedAt": time.Now().Unix(),
+						},
+					},
+					"nextToken": "page-2",
+				}
+			}
+
+			return map[string]any{
+				"imageDetails": []any{
+					map[string]any{
+						"imageDigest":   LATEST_FAKE_DIGEST,
+						"imageTags":     []string{"1.2.0"},
+						"imagePushedAt": time.Now().Unix(),
+					},
+				},
+			}
+		})
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.1.0", Digest: OLDER_FAKE_DIGEST},
+			{Tag: "1.2.0", Digest: LATEST_FAKE_DIGEST},
+		}))
+
+		Expect(ecr.Requests("DescribeImages")).To(HaveLen(2))
+	})
+})
+
+var _ = Describe("checking with upload times from a Google registry", func() {
+	var registryServer *httptest.Server
+	var req resource.CheckRequest
+
+	var buildA, buildB, buildC v1.Image
+
+	var uploaded map[string]time.Time
+	var pageSize, listRequests int
+
+	BeforeEach(func() {
+		backend := registry.New(registry.Logger(log.New(GinkgoWriter, "registry: ", 0)))
+
+		uploaded = map[string]time.Time{}
+		pageSize = 0
+		listRequests = 0
+
+		// extend the tag list with manifest details, as GCR does
+		registryServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/tags/list") {
+				backend.ServeHTTP(w, r)
+				return
+			}
+
+			listRequests++
+
+			rec := httptest.NewRecorder()
+			backend.ServeHTTP(rec, r)
+
+			var list map[string]any
+			Expect(json.Unmarshal(rec.Body.Bytes(), &list)).To(Succeed())
+
+			tags := list["tags"].([]any)
+			if pageSize > 0 && len(tags) > pageSize {
+				list["tags"] = tags[:pageSize]
+				w.Header().Set("Link", fmt.Sprintf(`<%s?n=1000&last=%s>; rel="next"`, r.URL.Path, tags[pageSize-1]))
+			}
+
+			manifests := map[string]any{}
+			for tag, at := range uploaded {
+				manifests["sha256:"+tag] = map[string]any{
+					"tag":            []string{tag},
+					"timeUploadedMs": strconv.FormatInt(at.UnixMilli(), 10),
+				}
+			}
+
+			list["manifest"] = manifests
+
+			json.NewEncoder(w).Encode(list)
+		}))
+
+		repo := registryServer.Listener.Addr().String() + "/test-image"
+
+		buildA = pushCreatedAt(repo+":build-a", time.Now().Add(-10*time.Hour))
+		buildB = pushCreatedAt(repo+":build-b", time.Now().Add(-time.Hour))
+		buildC = pushCreatedAt(repo+":build-c", time.Now().Add(-2*time.Hour))
+
+		uploaded["build-a"] = time.Now().Add(-time.Hour)
+		uploaded["build-b"] = time.Now().Add(-3 * time.Hour)
+		uploaded["build-c"] = time.Now().Add(-2 * time.Hour)
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository:   repo,
+				Regex:        "build-.*",
+				PushedAtSort: true,
+			},
+		}
+	})
+
+	AfterEach(func() {
+		registryServer.Close()
+	})
+
+	It("sorts by upload time with a single tag list request", func() {
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "build-b", Digest: imageDigest(buildB)},
+			{Tag: "build-c", Digest: imageDigest(buildC)},
+			{Tag: "build-a", Digest: imageDigest(buildA)},
+		}))
+
+		Expect(listRequests).To(Equal(1))
+	})
+
+	It("follows pagination of the tag list", func() {
+		pageSize = 2
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "build-b", Digest: imageDigest(buildB)},
+			{Tag: "build-c", Digest: imageDigest(buildC)},
+			{Tag: "build-a", Digest: imageDigest(buildA)},
+		}))
+
+		Expect(listRequests).To(Equal(2))
+	})
+
+	Context("when an image was created at the epoch", func() {
+		var reproducible v1.Image
+
+		BeforeEach(func() {
+			repo := req.Source.Repository
+
+			reproducible = pushCreatedAt(repo+":build-d", time.Unix(0, 0))
+			uploaded["build-d"] = time.Now().Add(-5 * 24 * time.Hour)
+
+			req.Source.PushedAtSort = false
+			req.Source.MinAge = resource.Duration(72 * time.Hour)
+		})
+
+		It("tells its age by its upload time", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "build-d", Digest: imageDigest(reproducible)},
+			}))
+		})
+	})
+
+	Context("when a tag has no upload time", func() {
+		BeforeEach(func() {
+			delete(uploaded, "build-c")
+		})
+
+		It("sorts every tag by creation time", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "build-a", Digest: imageDigest(buildA)},
+				{Tag: "build-c", Digest: imageDigest(buildC)},
+				{Tag: "build-b", Digest: imageDigest(buildB)},
+			}))
+		})
+	})
+})
+
+var _ = Describe("checking with an ECR scan gate", func() {
+	var registryServer *httptest.Server
+	var ecr *fakeECR
+	var req resource.CheckRequest
+
+	var clean, vulnerable, scanning, indexChild v1.Image
+	var index v1.ImageIndex
+
+	// scan results by image digest
+	var scans map[string]map[string]any
+
+	BeforeEach(func() {
+		registryServer = newTestRegistry()
+		repo := registryServer.Listener.Addr().String() + "/test-image"
+
+		clean = pushRandomImage(repo + ":1.0.0")
+		vulnerable = pushRandomImage(repo + ":1.1.0")
+		scanning = pushRandomImage(repo + ":1.2.0")
+
+		var err error
+		indexChild, err = random.Image(1024, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		index = mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+			Add: indexChild,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+			},
+		})
+
+		tag, err := name.NewTag(repo + ":1.3.0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.WriteIndex(tag, index)).To(Succeed())
+
+		scans = map[string]map[string]any{
+			imageDigest(clean): {
+				"imageScanStatus":   map[string]any{"status": "COMPLETE"},
+				"imageScanFindings": map[string]any{"findingSeverityCounts": map[string]int{"LOW": 3}},
+			},
+			imageDigest(vulnerable): {
+				"imageScanStatus":   map[string]any{"status": "COMPLETE"},
+				"imageScanFindings": map[string]any{"findingSeverityCounts": map[string]int{"CRITICAL": 1, "LOW": 2}},
+			},
+			imageDigest(scanning): {
+				"imageScanStatus": map[string]any{"status": "IN_PROGRESS"},
+			},
+			imageDigest(indexChild): {
+				"imageScanStatus":   map[string]any{"status": "COMPLETE"},
+				"imageScanFindings": map[string]any{"findingSeverityCounts": map[string]int{"HIGH": 1}},
+			},
+		}
+
+		ecr = newFakeECR("https://" + registryServer.Listener.Addr().String())
+		ecr.RespondTo("DescribeImageScanFindings", func(input map[string]any) any {
+			digest := input["imageId"].(map[string]any)["imageDigest"].(string)
+			return scans[digest]
+		})
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository: "test-image",
+				RawPlatform: &resource.PlatformField{
+					OS:           "linux",
+					Architecture: "amd64",
+				},
+				AwsCredentials: resource.AwsCredentials{
+					AwsAccessKeyId:     "some-access-key",
+					AwsSecretAccessKey: "some-secret-key",
+					AwsRegion:          "us-east-1",
+					AwsEcrEndpoint:     ecr.URL,
+				},
+				ScanGate: &resource.ScanGate{
+					MaxFindings: map[string]int{"critical": 0},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		ecr.Close()
+		registryServer.Close()
+	})
+
+	It("withholds versions with too many findings or an incomplete scan", func() {
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		digest, err := index.Digest()
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(clean)},
+			{Tag: "1.3.0", Digest: digest.String()},
+		}))
+	})
+
+	It("judges an index by the scan of its platform image", func() {
+		req.Source.ScanGate.MaxFindings["HIGH"] = 0
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(clean)},
+		}))
+	})
+
+	It("withholds versions whose scan failed", func() {
+		delete(scans, imageDigest(clean))
+		ecr.RespondTo("DescribeImageScanFindings", func(input map[string]any) any {
+			digest := input["imageId"].(map[string]any)["imageDigest"].(string)
+			if scans[digest] == nil {
+				return map[string]any{"imageScanStatus": map[string]any{"status": "FAILED"}}
+			}
+
+			return scans[digest]
+		})
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		digest, err := index.Digest()
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.3.0", Digest: digest.String()},
+		}))
+	})
+
+	Context("when invoked with a cursor version", func() {
+		BeforeEach(func() {
+			req.Version = &resource.Version{
+				Tag:    "1.1.0",
+				Digest: imageDigest(vulnerable),
+			}
+		})
+
+		It("only gates the versions after the cursor", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			digest, err := index.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.1.0", Digest: imageDigest(vulnerable)},
+				{Tag: "1.3.0", Digest: digest.String()},
+			}))
+
+			Expect(ecr.Requests("DescribeImageScanFindings")).To(HaveLen(2))
+		})
+	})
+})
+
+var _ = Describe("checking with signature verification", func() {
+	var registryServer *httptest.Server
+	var req resource.CheckRequest
+
+	var repo string
+	var key, otherKey *ecdsa.PrivateKey
+	var signed, unsigned v1.Image
+
+	publicKeyPEM := func(key *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		Expect(err).ToNot(HaveOccurred())
+
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+
+	// signatureImage builds a cosign signature image over a simple signing
+	// payload for the digest
+	signatureImage := func(key *ecdsa.PrivateKey, digest string, optional map[string]any) v1.Image {
+		payload, err := json.Marshal(map[string]any{
+			"critical": map[string]any{
+				"identity": map[string]any{"docker-reference": repo},
+				"image":    map[string]any{"docker-manifest-digest": digest},
+				"type":     "cosign container image signature",
+			},
+			"optional": optional,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		hash := sha256.Sum256(payload)
+		signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+		Expect(err).ToNot(HaveOccurred())
+
+		image, err := mutate.Append(empty.Image, mutate.Addendum{
+			Layer: static.NewLayer(payload, "application/vnd.dev.cosign.simplesigning.v1+json"),
+			Annotations: map[string]string{
+				"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(signature),
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		return image
+	}
+
+	signatureTag := func(digest string) string {
+		return repo + ":" + strings.Replace(digest, ":", "-", 1) + ".sig"
+	}
+
+	BeforeEach(func() {
+		registryServer = newTestRegistry(registry.WithReferrersSupport(true))
+		repo = registryServer.Listener.Addr().String() + "/test-image"
+
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		otherKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		signed = pushRandomImage(repo + ":1.0.0")
+		unsigned = pushRandomImage(repo + ":1.1.0")
+
+		pushImage(signatureTag(imageDigest(signed)), signatureImage(key, imageDigest(signed), map[string]any{"team": "platform"}))
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository: repo,
+				VerifySignatures: &resource.VerifySignatures{
+					PublicKeys: []string{publicKeyPEM(key)},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		registryServer.Close()
+	})
+
+	It("only emits signed versions", func() {
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(signed)},
+		}))
+	})
+
+	It("accepts a signature by any of the keys", func() {
+		req.Source.VerifySignatures.PublicKeys = []string{publicKeyPEM(otherKey), publicKeyPEM(key)}
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(signed)},
+		}))
+	})
+
+	It("ignores signatures by other keys", func() {
+		req.Source.VerifySignatures.PublicKeys = []string{publicKeyPEM(otherKey)}
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{}))
+	})
+
+	It("ignores signatures for another digest", func() {
+		// a valid signature of 1.0.0, copied to the signature tag of 1.1.0
+		pushImage(signatureTag(imageDigest(unsigned)), signatureImage(key, imageDigest(signed), nil))
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "1.0.0", Digest: imageDigest(signed)},
+		}))
+	})
+
+	It("requires the configured annotations", func() {
+		req.Source.VerifySignatures.Annotations = map[string]string{"team": "platform"}
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+		Expect(res).To(HaveLen(1))
+
+		req.Source.VerifySignatures.Annotations = map[string]string{"team": "other"}
+
+		res = SemverOrRegexTagCheckExample{}.check(req)
+		Expect(res).To(Equal(resource.CheckResponse{}))
+	})
+
+	Context("with signatures attached as referrers", func() {
+		BeforeEach(func() {
+			subject, err := name.NewDigest(repo + "@" + imageDigest(unsigned))
+			Expect(err).ToNot(HaveOccurred())
+
+			desc, err := remote.Head(subject)
+			Expect(err).ToNot(HaveOccurred())
+
+			signature := mutate.ConfigMediaType(
+				mutate.MediaType(signatureImage(key, imageDigest(unsigned), nil), types.OCIManifestSchema1),
+				"application/vnd.dev.cosign.artifact.sig.v1+json",
+			)
+			signature = mutate.Subject(signature, *desc).(v1.Image)
+
+			digest, err := signature.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			ref, err := name.NewDigest(repo + "@" + digest.String())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remote.Write(ref, signature)).To(Succeed())
+		})
+
+		It("finds them", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.0.0", Digest: imageDigest(signed)},
+				{Tag: "1.1.0", Digest: imageDigest(unsigned)},
+			}))
+		})
+
+		It("finds them when the signature tag has no valid signature", func() {
+			pushImage(signatureTag(imageDigest(unsigned)), signatureImage(otherKey, imageDigest(unsigned), nil))
+
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "1.0.0", Digest: imageDigest(signed)},
+				{Tag: "1.1.0", Digest: imageDigest(unsigned)},
+			}))
+		})
+	})
+})
+
+var _ = Describe("checking the referrers of a tag", func() {
+	var registryServer *httptest.Server
+	var req resource.CheckRequest
+
+	var repo string
+	var olderSBOM, newerSBOM, attestation string
+
+	// attach pushes an artifact of the given type which refers to the subject
+	attach := func(subject string, artifactType string, created string) string {
+		ref, err := name.NewTag(subject)
+		Expect(err).ToNot(HaveOccurred())
+
+		desc, err := remote.Head(ref)
+		Expect(err).ToNot(HaveOccurred())
+
+		layer := static.NewLayer([]byte(created), "application/json")
+		artifact, err := mutate.Append(empty.Image, mutate.Addendum{Layer: layer})
+		Expect(err).ToNot(HaveOccurred())
+
+		artifact = mutate.ConfigMediaType(mutate.MediaType(artifact, types.OCIManifestSchema1), types.MediaType(artifactType))
+		artifact = mutate.Annotations(artifact, map[string]string{"org.opencontainers.image.created": created}).(v1.Image)
+		artifact = mutate.Subject(artifact, *desc).(v1.Image)
+
+		digest, err := artifact.Digest()
+		Expect(err).ToNot(HaveOccurred())
+
+		digestRef, err := name.NewDigest(repo + "@" + digest.String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.Write(digestRef, artifact)).To(Succeed())
+
+		return digest.String()
+	}
+
+	setup := func(opts ...registry.Option) {
+		registryServer = newTestRegistry(opts...)
+		repo = registryServer.Listener.Addr().String() + "/test-image"
+
+		pushRandomImage(repo + ":release")
+
+		newerSBOM = attach(repo+":release", "application/spdx+json", "2024-02-01T00:00:00Z")
+		olderSBOM = attach(repo+":release", "application/spdx+json", "2024-01-01T00:00:00Z")
+		attestation = attach(repo+":release", "application/vnd.in-toto+json", "2024-01-15T00:00:00Z")
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository: repo,
+				ReferrersOf: &resource.ReferrersOf{
+					Tag: "release",
+				},
+			},
+		}
+	}
+
+	AfterEach(func() {
+		registryServer.Close()
+	})
+
+	Context("with the referrers API", func() {
+		BeforeEach(func() {
+			setup(registry.WithReferrersSupport(true))
+		})
+
+		It("emits every referrer in order of creation", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "release", Digest: olderSBOM},
+				{Tag: "release", Digest: attestation},
+				{Tag: "release", Digest: newerSBOM},
+			}))
+		})
+
+		It("filters by artifact type", func() {
+			req.Source.ReferrersOf.ArtifactTypes = []string{"application/spdx+json"}
+
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "release", Digest: olderSBOM},
+				{Tag: "release", Digest: newerSBOM},
+			}))
+		})
+
+		It("emits the referrers from the given version onwards", func() {
+			req.Version = &resource.Version{Tag: "release", Digest: attestation}
+
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "release", Digest: attestation},
+				{Tag: "release", Digest: newerSBOM},
+			}))
+		})
+	})
+
+	Context("with the tag schema fallback", func() {
+		BeforeEach(func() {
+			setup()
+		})
+
+		It("emits every referrer in order of creation", func() {
+			res := SemverOrRegexTagCheckExample{}.check(req)
+
+			Expect(res).To(Equal(resource.CheckResponse{
+				{Tag: "release", Digest: olderSBOM},
+				{Tag: "release", Digest: attestation},
+				{Tag: "release", Digest: newerSBOM},
+			}))
+		})
+	})
+})
+
+var _ = Describe("checking for base image updates", func() {
+	var registryServer *httptest.Server
+	var req resource.CheckRequest
+
+	var repo, baseTag string
+	var base, app v1.Image
+
+	BeforeEach(func() {
+		registryServer = newTestRegistry()
+		repo = registryServer.Listener.Addr().String() + "/app"
+		baseTag = registryServer.Listener.Addr().String() + "/base:3.19"
+
+		base = pushRandomImage(baseTag)
+
+		image, err := random.Image(1024, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		app = mutate.Annotations(image, map[string]string{
+			"org.opencontainers.image.base.name":   baseTag,
+			"org.opencontainers.image.base.digest": imageDigest(base),
+		}).(v1.Image)
+
+		pushImage(repo+":latest", app)
+
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository:     repo,
+				Tag:            "latest",
+				TrackBaseImage: true,
+			},
+		}
+	})
+
+	AfterEach(func() {
+		registryServer.Close()
+	})
+
+	It("records the digest of the base image", func() {
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "latest", Digest: imageDigest(app), BaseDigest: imageDigest(base)},
+		}))
+	})
+
+	It("emits a new version when the base image's tag moves", func() {
+		req.Version = &resource.Version{Tag: "latest", Digest: imageDigest(app), BaseDigest: imageDigest(base)}
+
+		patched := pushRandomImage(baseTag)
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "latest", Digest: imageDigest(app), BaseDigest: imageDigest(base)},
+			{Tag: "latest", Digest: imageDigest(app), BaseDigest: imageDigest(patched)},
+		}))
+	})
+
+	It("reads the base image from labels", func() {
+		image, err := random.Image(1024, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		labelled, err := mutate.Config(image, v1.Config{
+			Labels: map[string]string{
+				"org.opencontainers.image.base.name":   baseTag,
+				"org.opencontainers.image.base.digest": "sha256:" + strings.Repeat("0", 64),
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		pushImage(repo+":latest", labelled)
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "latest", Digest: imageDigest(labelled), BaseDigest: imageDigest(base)},
+		}))
+	})
+
+	It("ignores a base image recorded by digest alone", func() {
+		image, err := random.Image(1024, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		pinned := mutate.Annotations(image, map[string]string{
+			"org.opencontainers.image.base.name":   registryServer.Listener.Addr().String() + "/base@" + imageDigest(base),
+			"org.opencontainers.image.base.digest": imageDigest(base),
+		}).(v1.Image)
+
+		pushImage(repo+":latest", pinned)
+
+		res := SemverOrRegexTagCheckExample{}.check(req)
+
+		Expect(res).To(Equal(resource.CheckResponse{
+			{Tag: "latest", Digest: imageDigest(pinned)},
+		}))
+	})
+})
+
+var _ = Describe("checking with tag include or exclude regexes", func() {
+	var req resource.CheckRequest
+
+	BeforeEach(func() {
+		req = resource.CheckRequest{
+			Source: resource.Source{
+				Repository:      "registry.example.com/org/app",
+				TagIncludeRegex: `^1\.`,
+			},
+		}
+	})
+
+	Context("when checking a tag", func() {
+		BeforeEach(func() {
+			req.Source.Tag = "1.0.0"
+		})
+
+		It("returns an error", func() {
+			_, err := runCheck(req)
+			Expect(err).To(MatchError(ContainSubstring("tag_include_regex and tag_exclude_regex cannot be used with tag or tag_regex")))
+		})
+	})
+
+	Context("when checking a tag regex", func() {
+		BeforeEach(func() {
+			req.Source.Regex = `^1\.`
+			req.Source.TagIncludeRegex = ""
+			req.Source.TagExcludeRegex = `-debug$`
+		})
+
+		It("returns an error", func() {
+			_, err := runCheck(req)
+			Expect(err).To(MatchError(ContainSubstring("tag_include_regex and tag_exclude_regex cannot be used with tag or tag_regex")))
+		})
+	})
+})
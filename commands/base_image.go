@@ -0,0 +1,138 @@
+package commands
+
+import (
+	"fmt"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/sirupsen/logrus"
+)
+
+// the pre-defined OCI annotations recording the image an image was built on
+const (
+	baseNameAnnotation   = "org.opencontainers.image.base.name"
+	baseDigestAnnotation = "org.opencontainers.image.base.digest"
+)
+
+// checkBaseImage emits the tag's image along with the digest that the tag of
+// its base image points to now. When the base image's tag moves, the version
+// changes even though the image hasn't, so that it can be rebuilt.
+func checkBaseImage(tag name.Tag, source resource.Source, from *resource.Version, opts ...remote.Option) (resource.CheckResponse, error) {
+	response, err := checkTag(tag, from, opts...)
+	if err != nil {
+		return resource.CheckResponse{}, err
+	}
+
+	if len(response) == 0 {
+		return response, nil
+	}
+
+	current := &response[len(response)-1]
+
+	baseName, baseDigest, err := baseImageOf(tag.Repository.Digest(current.Digest), opts...)
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("get base image of %s: %w", tag, err)
+	}
+
+	if baseName == "" {
+		logrus.Warnf("%s does not record its base image", tag)
+		return response, nil
+	}
+
+	if _, err := name.NewDigest(baseName); err == nil {
+		logrus.Warnf("%s records its base image %s by digest, which cannot move", tag, baseName)
+		return response, nil
+	}
+
+	baseRef, err := name.NewTag(baseName)
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("parse base image tag: %w", err)
+	}
+
+	baseSource := source
+	baseSource.Repository = baseRef.Context().Name()
+	if baseRef.RegistryStr() != tag.RegistryStr() {
+		// don't send the image's credentials to the base image's registry
+		baseSource.BasicCredentials = resource.BasicCredentials{}
+	}
+
+	baseOpts, err := baseSource.AuthOptions(baseRef.Context(), []string{transport.PullScope})
+	if err != nil {
+		return resource.CheckResponse{}, err
+	}
+
+	latestBase, found, err := headOrGet(baseRef, baseOpts...)
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("get base image digest: %w", err)
+	}
+
+	current.BaseDigest = baseDigest
+	if found && latestBase.String() != baseDigest {
+		logrus.Infof("base image %s has moved from %s to %s", baseRef, baseDigest, latestBase)
+		current.BaseDigest = latestBase.String()
+	}
+
+	if from != nil && from.Digest == current.Digest && *from != *current {
+		// only the base image has moved
+		return resource.CheckResponse{*from, *current}, nil
+	}
+
+	if len(response) > 1 {
+		// keep the previous version as it was, rather than as checkTag
+		// reconstructed it
+		response[0] = *from
+	}
+
+	return response, nil
+}
+
+// baseImageOf returns the base image recorded in the annotations of the
+// image, or of the image for the configured platform in an index, or in its
+// labels.
+func baseImageOf(ref name.Digest, opts ...remote.Option) (string, string, error) {
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return "", "", err
+	}
+
+	annotations, err := parseAnnotations(desc.Manifest)
+	if err != nil {
+		return "", "", err
+	}
+
+	if annotations[baseNameAnnotation] != "" {
+		return annotations[baseNameAnnotation], annotations[baseDigestAnnotation], nil
+	}
+
+	image, err := desc.Image()
+	if err != nil {
+		return "", "", fmt.Errorf("resolve image: %w", err)
+	}
+
+	if desc.MediaType.IsIndex() {
+		manifest, err := image.RawManifest()
+		if err != nil {
+			return "", "", fmt.Errorf("get image manifest: %w", err)
+		}
+
+		annotations, err = parseAnnotations(manifest)
+		if err != nil {
+			return "", "", err
+		}
+
+		if annotations[baseNameAnnotation] != "" {
+			return annotations[baseNameAnnotation], annotations[baseDigestAnnotation], nil
+		}
+	}
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		return "", "", fmt.Errorf("get image config: %w", err)
+	}
+
+	labels := config.Config.Labels
+
+	return labels[baseNameAnnotation], labels[baseDigestAnnotation], nil
+}
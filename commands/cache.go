@@ -0,0 +1,241 @@
+package commands
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// default size limit of the layer cache
+const defaultCacheMaxSizeMB = 10 * 1024
+
+// downloads which haven't been written to for this long were abandoned by a
+// process which died, as a live download keeps writing
+const staleDownloadAge = time.Hour
+
+// blobCache stores compressed layers by digest, so that images sharing
+// layers don't download them again. It may be shared by concurrent
+// containers, so changes to it are made under a lock file, and blobs are
+// only ever renamed into place complete. Least recently used blobs are
+// evicted once the cache grows past its size limit.
+type blobCache struct {
+	dir     string
+	maxSize int64
+}
+
+func newBlobCache(dir string, maxSizeMB int64) (*blobCache, error) {
+	if maxSizeMB == 0 {
+		maxSizeMB = defaultCacheMaxSizeMB
+	}
+
+	cache := &blobCache{
+		dir:     dir,
+		maxSize: maxSizeMB * 1024 * 1024,
+	}
+
+	err := os.MkdirAll(cache.blobsDir(), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+
+	err = cache.locked(cache.removeStaleDownloads)
+	if err != nil {
+		return nil, fmt.Errorf("remove stale downloads: %w", err)
+	}
+
+	return cache, nil
+}
+
+// removeStaleDownloads removes the temp files of downloads which were
+// abandoned, e.g. by a container which was killed. It must be called with the
+// lock held.
+func (cache *blobCache) removeStaleDownloads() error {
+	downloads, err := filepath.Glob(filepath.Join(cache.dir, "download-*"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range downloads {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		if time.Since(info.ModTime()) < staleDownloadAge {
+			continue
+		}
+
+		logrus.Debugf("removing stale download %s", path)
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cache *blobCache) blobsDir() string {
+	return filepath.Join(cache.dir, "blobs")
+}
+
+func (cache *blobCache) blobPath(digest v1.Hash) string {
+	return filepath.Join(cache.blobsDir(), digest.Algorithm, digest.Hex)
+}
+
+// TempFile creates a file for a download which will be stored in the cache,
+// on the same filesystem so that it can be renamed into place.
+func (cache *blobCache) TempFile() (*os.File, error) {
+	return os.CreateTemp(cache.dir, "download-")
+}
+
+// Open returns the cached blob, if there is one, and marks it as recently
+// used. The blob stays readable even if it is evicted while open.
+func (cache *blobCache) Open(digest v1.Hash) (*os.File, bool, error) {
+	var f *os.File
+	err := cache.locked(func() error {
+		var err error
+		f, err = os.Open(cache.blobPath(digest))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		return os.Chtimes(f.Name(), now, now)
+	})
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return f, true, nil
+}
+
+// Store moves a complete download into the cache, evicting the least
+// recently used blobs if the cache is over its size limit, and opens it.
+func (cache *blobCache) Store(digest v1.Hash, path string) (*os.File, error) {
+	var f *os.File
+	err := cache.locked(func() error {
+		blobPath := cache.blobPath(digest)
+
+		err := os.MkdirAll(filepath.Dir(blobPath), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(path, blobPath)
+		if err != nil {
+			return err
+		}
+
+		f, err = os.Open(blobPath)
+		if err != nil {
+			return err
+		}
+
+		return cache.evict()
+	})
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+
+		return nil, fmt.Errorf("store %s in cache: %w", digest, err)
+	}
+
+	return f, nil
+}
+
+// evict removes the least recently used blobs until the cache fits within
+// its size limit. It must be called with the lock held.
+func (cache *blobCache) evict() error {
+	type blob struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var blobs []blob
+	var total int64
+	err := filepath.WalkDir(cache.blobsDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		blobs = append(blobs, blob{path, info.Size(), info.ModTime()})
+		total += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].modTime.Before(blobs[j].modTime)
+	})
+
+	for _, b := range blobs {
+		if total <= cache.maxSize {
+			break
+		}
+
+		logrus.Debugf("evicting %s from cache", b.path)
+
+		err := os.Remove(b.path)
+		if err != nil {
+			return err
+		}
+
+		total -= b.size
+	}
+
+	return nil
+}
+
+// locked runs f with an exclusive lock on the cache, shared with any other
+// process using the same directory.
+func (cache *blobCache) locked(f func() error) error {
+	lockFile, err := os.OpenFile(filepath.Join(cache.dir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("open lock file: %w", err)
+	}
+
+	defer lockFile.Close()
+
+	err = lockExclusive(lockFile)
+	if err != nil {
+		return fmt.Errorf("lock cache: %w", err)
+	}
+
+	defer unlock(lockFile)
+
+	return f()
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package commands
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockExclusive(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
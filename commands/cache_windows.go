@@ -0,0 +1,18 @@
+//go:build windows
+
+package commands
+
+import (
+	"os"
+)
+
+// the cache is not locked on Windows, so it must not be shared between
+// processes there
+
+func lockExclusive(f *os.File) error {
+	return nil
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
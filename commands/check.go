@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -51,44 +54,343 @@ func (c *Check) Execute() error {
 		return fmt.Errorf("invalid payload: %s", err)
 	}
 
-	if req.Source.AwsRegion != "" {
-		if !req.Source.AuthenticateToECR() {
-			return fmt.Errorf("cannot authenticate with ECR")
+	var response resource.CheckResponse
+	if len(req.Source.Repositories) > 0 {
+		response, err = checkRepositories(req.Source, req.Version)
+	} else {
+		response, err = checkWithMirror(req.Source, req.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(c.stdout).Encode(response)
+	if err != nil {
+		return fmt.Errorf("could not marshal JSON: %s", err)
+	}
+
+	return nil
+}
+
+func checkWithMirror(source resource.Source, from *resource.Version) (resource.CheckResponse, error) {
+	if source.ScanGate != nil && source.AwsRegion == "" {
+		return nil, fmt.Errorf("scan_gate is only supported for ECR repositories")
+	}
+
+	if source.AwsEcrDescribeImages && source.AwsRegion == "" {
+		return nil, fmt.Errorf("aws_ecr_describe_images is only supported for ECR repositories")
+	}
+
+	if source.AwsRegion != "" {
+		if !source.AuthenticateToECR() {
+			return nil, fmt.Errorf("cannot authenticate with ECR")
 		}
 	}
 
-	mirrorSource, hasMirror, err := req.Source.Mirror()
+	// the repository as configured, for content trust and the ECR API
+	configured := source
+
+	source, err := source.Rewrite()
 	if err != nil {
-		return fmt.Errorf("failed to resolve mirror: %w", err)
+		return nil, fmt.Errorf("failed to rewrite repository: %w", err)
+	}
+
+	mirrors, err := source.Mirrors()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve mirror: %w", err)
 	}
 
 	var response resource.CheckResponse
 
-	if hasMirror {
-		response, err = check(mirrorSource, req.Version)
-		if err != nil {
-			logrus.Warnf("checking mirror %s failed: %s", mirrorSource.Repository, err)
-		} else if len(response) == 0 {
-			logrus.Warnf("checking mirror %s failed: tag not found", mirrorSource.Repository)
+	for _, mirror := range mirrors {
+		response, err = check(mirror.Source, from)
+		if err == nil && len(response) == 0 {
+			err = fmt.Errorf("tag not found")
 		}
+
+		if err == nil {
+			err = verifyMirror(source, mirror, response[len(response)-1])
+			if err != nil {
+				if mirror.Mirror.Verify == resource.MirrorVerifyFail {
+					return nil, err
+				}
+
+				// the origin is the source of truth, and the mirror may be stale
+				// for older versions too
+				logrus.Warnf("%s; checking origin instead", err)
+				response = nil
+			}
+
+			break
+		}
+
+		if mirror.Mirror.Fatal {
+			return nil, fmt.Errorf("checking mirror %s failed: %w", mirror.Repository, err)
+		}
+
+		logrus.Warnf("checking mirror %s failed: %s", mirror.Repository, err)
 	}
 
 	if len(response) == 0 {
-		response, err = check(req.Source, req.Version)
+		response, err = check(source, from)
 		if err != nil {
-			return fmt.Errorf("checking origin %s failed: %w", req.Source.Repository, err)
+			return nil, fmt.Errorf("checking origin %s failed: %w", source.Repository, err)
 		}
 	}
 
-	err = json.NewEncoder(c.stdout).Encode(response)
+	if source.VerifySignatures != nil {
+		response, err = filterBySignatures(source, response)
+		if err != nil {
+			return nil, fmt.Errorf("verifying signatures failed: %w", err)
+		}
+	}
+
+	if source.ContentTrust != nil && source.ContentTrust.VerifyOnCheck {
+		response, err = filterByTrust(configured, response)
+		if err != nil {
+			return nil, fmt.Errorf("verifying content trust failed: %w", err)
+		}
+	}
+
+	if source.ScanGate != nil {
+		return gateOnScanFindings(configured, from, response)
+	}
+
+	return response, nil
+}
+
+// gateOnScanFindings withholds versions whose ECR image scan hasn't
+// completed, or has more findings than the scan gate allows. An index is
+// judged by the scan of the image for the configured platform, as ECR scans
+// images rather than indexes. The cursor version already passed the gate, so
+// only the versions after it are scanned.
+func gateOnScanFindings(source resource.Source, from *resource.Version, response resource.CheckResponse) (resource.CheckResponse, error) {
+	repo, err := source.NewRepository()
 	if err != nil {
-		return fmt.Errorf("could not marshal JSON: %s", err)
+		return nil, fmt.Errorf("resolve repository: %w", err)
+	}
+
+	opts, err := source.AuthOptions(repo, []string{transport.PullScope})
+	if err != nil {
+		return nil, err
+	}
+
+	gated := resource.CheckResponse{}
+	for _, version := range response {
+		if from != nil && version.Tag == from.Tag && version.Digest == from.Digest {
+			gated = append(gated, version)
+			continue
+		}
+
+		desc, err := remote.Get(repo.Digest(version.Digest), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", version.Tag, err)
+		}
+
+		scanned := version.Digest
+		if desc.MediaType.IsIndex() {
+			image, err := desc.Image()
+			if err != nil {
+				return nil, fmt.Errorf("resolve platform image of %s: %w", version.Tag, err)
+			}
+
+			digest, err := image.Digest()
+			if err != nil {
+				return nil, fmt.Errorf("get platform image digest of %s: %w", version.Tag, err)
+			}
+
+			scanned = digest.String()
+		}
+
+		complete, counts, err := source.ECRScanFindings(scanned)
+		if err != nil {
+			return nil, fmt.Errorf("get scan findings of %s: %w", version.Tag, err)
+		}
+
+		if !complete {
+			logrus.Infof("skipping %s: image scan has not completed", version.Tag)
+			continue
+		}
+
+		logrus.Infof("%s scan findings: %v", version.Tag, counts)
+
+		exceeded := source.ScanGate.Exceeded(counts)
+		if len(exceeded) > 0 {
+			logrus.Warnf("skipping %s: too many %s findings", version.Tag, strings.Join(exceeded, ", "))
+			continue
+		}
+
+		gated = append(gated, version)
+	}
+
+	return gated, nil
+}
+
+// verifyMirror compares the digest of the newest version found in a mirror
+// with a HEAD against the origin, to detect a stale or compromised mirror.
+// Failing to reach the origin fails the check with the fail policy, and is
+// otherwise only logged, as that may well be the reason for using a mirror in
+// the first place.
+func verifyMirror(origin resource.Source, mirror resource.MirrorSource, newest resource.Version) error {
+	if mirror.Mirror.Verify == "" {
+		return nil
+	}
+
+	unverified := func(err error) error {
+		if mirror.Mirror.Verify == resource.MirrorVerifyFail {
+			return fmt.Errorf("cannot verify mirror %s: %w", mirror.Repository, err)
+		}
+
+		logrus.Warnf("cannot verify mirror %s: %s", mirror.Repository, err)
+		return nil
+	}
+
+	repo, err := origin.NewRepository()
+	if err != nil {
+		return fmt.Errorf("resolve repository: %w", err)
+	}
+
+	opts, err := origin.AuthOptions(repo, []string{transport.PullScope})
+	if err != nil {
+		return unverified(err)
+	}
+
+	if origin.ReferrersOf != nil {
+		// versions are artifacts rather than tags, so check that the origin has
+		// the artifact
+		_, found, err := headOrGet(repo.Digest(newest.Digest), opts...)
+		if err != nil {
+			return unverified(err)
+		}
+
+		if !found {
+			return fmt.Errorf("mirror %s has %s, which is missing from origin %s", mirror.Repository, newest.Digest, origin.Repository)
+		}
+
+		return nil
+	}
+
+	digest, found, err := headOrGet(repo.Tag(newest.Tag), opts...)
+	if err != nil {
+		return unverified(err)
+	}
+
+	if !found {
+		return fmt.Errorf("mirror %s has tag %s, which is missing from origin %s", mirror.Repository, newest.Tag, origin.Repository)
+	}
+
+	if digest.String() != newest.Digest {
+		return fmt.Errorf("mirror %s diverges from origin %s: tag %s is %s on the mirror but %s on the origin", mirror.Repository, origin.Repository, newest.Tag, newest.Digest, digest)
 	}
 
 	return nil
 }
 
+// checkRepositories checks every configured repository for semver tags and
+// merges them into a single stream ordered by version. Each version records
+// the repository it was found in so that 'in' can fetch from it.
+func checkRepositories(source resource.Source, from *resource.Version) (resource.CheckResponse, error) {
+	if source.Tag != "" || source.Regex != "" || source.ReferrersOf != nil || source.TrackBaseImage {
+		return nil, fmt.Errorf("repositories can only be used when checking semver tags")
+	}
+
+	type repoVersion struct {
+		resource.Version
+		semver *semver.Version
+	}
+
+	var versions, bareVersions []repoVersion
+	for _, repository := range source.CheckedRepositories() {
+		repoSource := source
+		repoSource.Repository = repository
+		repoSource.Repositories = nil
+
+		// the cursor's digest is only meaningful in the repository it was found
+		// in; the other repositories are only checked for newer versions, so
+		// that older ones aren't filtered again on every check
+		repoFrom := from
+		if from != nil && from.Repository != repository {
+			repoFrom = &resource.Version{Tag: from.Tag}
+		}
+
+		response, err := checkWithMirror(repoSource, repoFrom)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, version := range response {
+			version.Repository = repository
+
+			verStr := version.Tag
+			if source.Variant != "" {
+				verStr = strings.TrimSuffix(verStr, "-"+source.Variant)
+			}
+
+			ver, err := semver.NewVersion(verStr)
+			if err != nil {
+				// the bare tag, i.e. 'latest' or the variant
+				bareVersions = append(bareVersions, repoVersion{Version: version})
+				continue
+			}
+
+			versions = append(versions, repoVersion{Version: version, semver: ver})
+		}
+	}
+
+	// the same image may be published to more than one repository; keep the
+	// first one found, favoring semver tags over bare tags
+	seenDigests := map[string]bool{}
+	dedupe := func(vs []repoVersion) []repoVersion {
+		var unique []repoVersion
+		for _, v := range vs {
+			if seenDigests[v.Digest] {
+				continue
+			}
+
+			seenDigests[v.Digest] = true
+			unique = append(unique, v)
+		}
+
+		return unique
+	}
+
+	// only the bare tag of the first repository which has one is emitted, as
+	// there is only one latest version
+	if len(bareVersions) > 1 {
+		bareVersions = bareVersions[:1]
+	}
+
+	versions = dedupe(versions)
+	bareVersions = dedupe(bareVersions)
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].semver.LessThan(versions[j].semver)
+	})
+
+	// like a single repository, start from the cursor if it's still there,
+	// as the other repositories were checked without it
+	if from != nil {
+		for i, v := range versions {
+			if v.Tag == from.Tag && v.Digest == from.Digest {
+				versions = versions[i:]
+				break
+			}
+		}
+	}
+
+	response := resource.CheckResponse{}
+	for _, v := range append(versions, bareVersions...) {
+		response = append(response, v.Version)
+	}
+
+	return response, nil
+}
+
 func check(source resource.Source, from *resource.Version) (resource.CheckResponse, error) {
+	if (source.TagIncludeRegex != "" || source.TagExcludeRegex != "") && (source.Tag != "" || source.Regex != "") {
+		return resource.CheckResponse{}, fmt.Errorf("tag_include_regex and tag_exclude_regex cannot be used with tag or tag_regex")
+	}
+
 	repo, err := source.NewRepository()
 	if err != nil {
 		return resource.CheckResponse{}, fmt.Errorf("resolve repository: %w", err)
@@ -99,21 +401,310 @@ func check(source resource.Source, from *resource.Version) (resource.CheckRespon
 		return resource.CheckResponse{}, err
 	}
 
-	if source.Tag != "" {
-		return checkTag(repo.Tag(source.Tag.String()), from, opts...)
-	} else if source.Regex != "" {
-		return checkRepositoryRegex(repo, source, opts...)
+	var response resource.CheckResponse
+	var listing tagListing
+	if source.ReferrersOf != nil {
+		if source.Tag != "" || source.Regex != "" {
+			return resource.CheckResponse{}, fmt.Errorf("referrers_of cannot be used with tag or tag_regex")
+		}
+
+		response, err = checkReferrers(repo, source, from, opts...)
+	} else if source.TrackBaseImage {
+		if source.Tag == "" {
+			return resource.CheckResponse{}, fmt.Errorf("track_base_image requires tag")
+		}
+
+		response, err = checkBaseImage(repo.Tag(source.Tag.String()), source, from, opts...)
+	} else if source.Tag != "" {
+		response, err = checkTag(repo.Tag(source.Tag.String()), from, opts...)
 	} else {
-		return checkRepository(repo, source, from, opts...)
+		listing, err = listTags(repo, source, opts...)
+		if err != nil {
+			return resource.CheckResponse{}, fmt.Errorf("list repository tags: %w", err)
+		}
+
+		if source.Regex != "" {
+			response, err = checkRepositoryRegex(repo, source, listing, opts...)
+		} else {
+			response, err = checkRepository(repo, source, from, listing, opts...)
+		}
+	}
+	if err != nil {
+		return resource.CheckResponse{}, err
 	}
+
+	return filterByAge(repo, source, response, listing, opts...)
+}
+
+// tagListing is the result of listing the tags of a repository. The ECR API
+// also reports the digest and push time of each tag, saving a request per
+// tag.
+type tagListing struct {
+	Tags     []string
+	Digests  map[string]v1.Hash
+	PushedAt map[string]time.Time
 }
 
-func checkRepository(repo name.Repository, source resource.Source, from *resource.Version, opts ...remote.Option) (resource.CheckResponse, error) {
-	tags, err := remote.List(repo, opts...)
+func listTags(repo name.Repository, source resource.Source, opts ...remote.Option) (tagListing, error) {
+	if !source.UsesECRAPI() {
+		if source.PushedAtSort {
+			// a single listing, which has the upload times on Google registries
+			return listGoogleTags(repo, source)
+		}
+
+		tags, err := remote.List(repo, opts...)
+		if err != nil {
+			return tagListing{}, err
+		}
+
+		return tagListing{Tags: tags}, nil
+	}
+
+	images, err := source.DescribeECRImages()
 	if err != nil {
-		return resource.CheckResponse{}, fmt.Errorf("list repository tags: %w", err)
+		return tagListing{}, err
+	}
+
+	listing := tagListing{
+		Digests:  map[string]v1.Hash{},
+		PushedAt: map[string]time.Time{},
 	}
 
+	for _, image := range images {
+		digest, err := v1.NewHash(image.Digest)
+		if err != nil {
+			return tagListing{}, fmt.Errorf("parse digest of %v: %w", image.Tags, err)
+		}
+
+		for _, tag := range image.Tags {
+			listing.Tags = append(listing.Tags, tag)
+			listing.Digests[tag] = digest
+			listing.PushedAt[tag] = image.PushedAt
+		}
+	}
+
+	return listing, nil
+}
+
+// googleTagList is the tag list returned by GCR and Artifact Registry, which
+// extends the standard response with details of each manifest.
+type googleTagList struct {
+	Tags     []string `json:"tags"`
+	Manifest map[string]struct {
+		Tag            []string `json:"tag"`
+		TimeUploadedMs string   `json:"timeUploadedMs"`
+	} `json:"manifest"`
+}
+
+// listGoogleTags lists the tags along with the upload time of each tag,
+// which GCR and Artifact Registry include in the tag list. Other registries
+// list their tags as usual, following pagination, with no upload times.
+func listGoogleTags(repo name.Repository, source resource.Source) (tagListing, error) {
+	rt, err := source.Transport(repo, []string{transport.PullScope})
+	if err != nil {
+		return tagListing{}, err
+	}
+
+	client := &http.Client{Transport: rt}
+
+	next := &url.URL{
+		Scheme:   repo.Registry.Scheme(),
+		Host:     repo.RegistryStr(),
+		Path:     fmt.Sprintf("/v2/%s/tags/list", repo.RepositoryStr()),
+		RawQuery: "n=1000",
+	}
+
+	listing := tagListing{}
+	for next != nil {
+		resp, err := client.Get(next.String())
+		if err != nil {
+			return tagListing{}, err
+		}
+
+		err = transport.CheckError(resp, http.StatusOK)
+		if err != nil {
+			resp.Body.Close()
+			return tagListing{}, err
+		}
+
+		var list googleTagList
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return tagListing{}, fmt.Errorf("decode tag list: %w", err)
+		}
+
+		listing.Tags = append(listing.Tags, list.Tags...)
+
+		for digest, manifest := range list.Manifest {
+			if manifest.TimeUploadedMs == "" {
+				continue
+			}
+
+			ms, err := strconv.ParseInt(manifest.TimeUploadedMs, 10, 64)
+			if err != nil {
+				return tagListing{}, fmt.Errorf("parse upload time of %s: %w", digest, err)
+			}
+
+			if listing.PushedAt == nil {
+				listing.PushedAt = map[string]time.Time{}
+			}
+
+			for _, tag := range manifest.Tag {
+				listing.PushedAt[tag] = time.UnixMilli(ms)
+			}
+		}
+
+		next, err = nextPageURL(resp)
+		if err != nil {
+			return tagListing{}, err
+		}
+	}
+
+	return listing, nil
+}
+
+// nextPageURL returns the URL of the next page of a paginated response from
+// its Link header, or nil if it is the last page.
+func nextPageURL(resp *http.Response) (*url.URL, error) {
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return nil, nil
+	}
+
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start == -1 || end < start || !strings.Contains(link[end:], `rel="next"`) {
+		return nil, nil
+	}
+
+	next, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return nil, fmt.Errorf("parse next page link: %w", err)
+	}
+
+	return resp.Request.URL.ResolveReference(next), nil
+}
+
+// digest returns the digest of the tag, from the listing if it has digests
+// and with a request to the registry otherwise.
+func (listing tagListing) digest(tagRef name.Tag, opts ...remote.Option) (v1.Hash, bool, error) {
+	if listing.Digests != nil {
+		digest, found := listing.Digests[tagRef.TagStr()]
+		return digest, found, nil
+	}
+
+	return headOrGet(tagRef, opts...)
+}
+
+// filterByAge withholds versions whose image was created (or pushed, where
+// the listing knows) more recently than min_age, or longer ago than max_age.
+// Reproducible builds set the creation time to the epoch, which says nothing
+// about the image's age, so their push time is used instead. Versions whose
+// age can't be told are withheld.
+func filterByAge(repo name.Repository, source resource.Source, response resource.CheckResponse, listing tagListing, opts ...remote.Option) (resource.CheckResponse, error) {
+	if source.MinAge == 0 && source.MaxAge == 0 {
+		return response, nil
+	}
+
+	now := time.Now()
+
+	// push times are only fetched if an image needs them
+	pushedAt := listing.PushedAt
+	fetchedPushTimes := pushedAt != nil
+
+	filtered := resource.CheckResponse{}
+	for _, version := range response {
+		created, found := listing.PushedAt[version.Tag]
+		if !found {
+			var err error
+			created, err = imageCreatedAt(repo.Digest(version.Digest), opts...)
+			if err != nil {
+				return resource.CheckResponse{}, fmt.Errorf("get creation time of %s: %w", version.Tag, err)
+			}
+		}
+
+		if !created.After(time.Unix(0, 0)) {
+			if !fetchedPushTimes {
+				fetchedPushTimes = true
+
+				var err error
+				pushedAt, err = registryPushTimes(repo, source)
+				if err != nil {
+					logrus.Warnf("failed to get push times: %s", err)
+				}
+			}
+
+			created, found = pushedAt[version.Tag]
+			if !found {
+				logrus.Warnf("skipping %s: it has no creation or push time to tell its age by", version.Tag)
+				continue
+			}
+		}
+
+		age := now.Sub(created)
+
+		if source.MinAge != 0 && age < time.Duration(source.MinAge) {
+			logrus.Infof("skipping %s: created %s ago, which is less than min_age %s", version.Tag, age.Round(time.Second), source.MinAge)
+			continue
+		}
+
+		if source.MaxAge != 0 && age > time.Duration(source.MaxAge) {
+			logrus.Debugf("skipping %s: created %s ago, which is more than max_age %s", version.Tag, age.Round(time.Second), source.MaxAge)
+			continue
+		}
+
+		filtered = append(filtered, version)
+	}
+
+	return filtered, nil
+}
+
+// registryPushTimes returns the push time of each tag, from the ECR API for
+// ECR repositories and from the tag list of Google registries. Other
+// registries don't report push times.
+func registryPushTimes(repo name.Repository, source resource.Source) (map[string]time.Time, error) {
+	if source.AwsRegion != "" {
+		images, err := source.DescribeECRImages()
+		if err != nil {
+			return nil, err
+		}
+
+		pushedAt := map[string]time.Time{}
+		for _, image := range images {
+			for _, tag := range image.Tags {
+				pushedAt[tag] = image.PushedAt
+			}
+		}
+
+		return pushedAt, nil
+	}
+
+	listing, err := listGoogleTags(repo, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return listing.PushedAt, nil
+}
+
+func imageCreatedAt(ref name.Reference, opts ...remote.Option) (time.Time, error) {
+	img, err := remote.Image(ref, opts...)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get remote image: %w", err)
+	}
+
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get remote image config file: %w", err)
+	}
+
+	return configFile.Created.Time, nil
+}
+
+func checkRepository(repo name.Repository, source resource.Source, from *resource.Version, listing tagListing, opts ...remote.Option) (resource.CheckResponse, error) {
+	tags := listing.Tags
+
 	bareTag := "latest"
 	if source.Variant != "" {
 		bareTag = source.Variant
@@ -133,6 +724,13 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 		})
 	}
 
+	if from != nil && from.Digest == "" {
+		// a cursor found in another repository, which only bounds the versions
+		// to consider
+		cursorVer, _ = semver.NewVersion(strings.TrimSuffix(from.Tag, "-"+source.Variant))
+	}
+
+	var err error
 	var constraint *semver.Constraints
 	if source.SemverConstraint != "" {
 		constraint, err = semver.NewConstraint(source.SemverConstraint)
@@ -141,11 +739,36 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 		}
 	}
 
+	var includeRegex, excludeRegex *regexp.Regexp
+	if source.TagIncludeRegex != "" {
+		includeRegex, err = regexp.Compile(source.TagIncludeRegex)
+		if err != nil {
+			return resource.CheckResponse{}, fmt.Errorf("parse tag include regex: %w", err)
+		}
+	}
+
+	if source.TagExcludeRegex != "" {
+		excludeRegex, err = regexp.Compile(source.TagExcludeRegex)
+		if err != nil {
+			return resource.CheckResponse{}, fmt.Errorf("parse tag exclude regex: %w", err)
+		}
+	}
+
 	for _, identifier := range tags {
 		var ver *semver.Version
 		if identifier == bareTag {
 			latestTag = identifier
 		} else {
+			if includeRegex != nil && !includeRegex.MatchString(identifier) {
+				// not explicitly included
+				continue
+			}
+
+			if excludeRegex != nil && excludeRegex.MatchString(identifier) {
+				// explicitly excluded
+				continue
+			}
+
 			verStr := identifier
 			if source.Variant != "" {
 				if !strings.HasSuffix(identifier, "-"+source.Variant) {
@@ -204,7 +827,7 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 
 		tagRef := repo.Tag(identifier)
 
-		digest, found, err := headOrGet(tagRef, opts...)
+		digest, found, err := listing.digest(tagRef, opts...)
 		if err != nil {
 			return resource.CheckResponse{}, fmt.Errorf("get tag digest: %w", err)
 		}
@@ -283,17 +906,12 @@ func checkRepository(repo name.Repository, source resource.Source, from *resourc
 	return response, nil
 }
 
-func checkRepositoryRegex(repo name.Repository, source resource.Source, opts ...remote.Option) (resource.CheckResponse, error) {
-	tags, err := remote.List(repo, opts...)
-	if err != nil {
-		return resource.CheckResponse{}, fmt.Errorf("list repository tags: %w", err)
-	}
-
+func checkRepositoryRegex(repo name.Repository, source resource.Source, listing tagListing, opts ...remote.Option) (resource.CheckResponse, error) {
 	tagDigests := map[string]string{}
 	tagToTimeDigests := map[string]time.Time{}
 	matchedTags := make([]string, 0)
 
-	for _, identifier := range tags {
+	for _, identifier := range listing.Tags {
 		regex, _ := regexp.Compile(source.Regex)
 		if !regex.MatchString(identifier) {
 			// Does not match regex string provided
@@ -302,7 +920,7 @@ func checkRepositoryRegex(repo name.Repository, source resource.Source, opts ...
 
 		tagRef := repo.Tag(identifier)
 
-		digest, found, err := headOrGet(tagRef, opts...)
+		digest, found, err := listing.digest(tagRef, opts...)
 		if err != nil {
 			return resource.CheckResponse{}, fmt.Errorf("get tag digest: %w", err)
 		}
@@ -311,9 +929,35 @@ func checkRepositoryRegex(repo name.Repository, source resource.Source, opts ...
 			continue
 		}
 
-		if source.CreatedAtSort {
+		matchedTags = append(matchedTags, identifier)
+
+		tagDigests[identifier] = digest.String()
+	}
+
+	// If CreatedAtSort or PushedAtSort is true, sort the matchedTags in descending order by looking up Time in tagToTimeDigests
+	if source.CreatedAtSort || source.PushedAtSort {
+		// push and creation times can't be compared, so every tag is sorted by
+		// the same one
+		usePushedAt := source.PushedAtSort
+		for _, identifier := range matchedTags {
+			if _, found := listing.PushedAt[identifier]; !found {
+				usePushedAt = false
+				break
+			}
+		}
+
+		if source.PushedAtSort && !usePushedAt {
+			logrus.Warnf("not every tag has a push time, sorting by creation time instead")
+		}
+
+		for _, identifier := range matchedTags {
+			if usePushedAt {
+				tagToTimeDigests[identifier] = listing.PushedAt[identifier]
+				continue
+			}
+
 			// Call Get to get the Image and History of the tag
-			img, err := remote.Image(tagRef, opts...)
+			img, err := remote.Image(repo.Tag(identifier), opts...)
 			if err != nil {
 				return resource.CheckResponse{}, fmt.Errorf("get remote image: %w", err)
 			}
@@ -326,13 +970,6 @@ func checkRepositoryRegex(repo name.Repository, source resource.Source, opts ...
 			tagToTimeDigests[identifier] = configFile.Created.Time
 		}
 
-		matchedTags = append(matchedTags, identifier)
-
-		tagDigests[identifier] = digest.String()
-	}
-
-	// If CreatedAtSort is true, sort the matchedTags in descending order by looking up Time in tagToTimeDigests
-	if source.CreatedAtSort {
 		sort.Slice(matchedTags, func(i, j int) bool {
 			return tagToTimeDigests[matchedTags[i]].Before(tagToTimeDigests[matchedTags[j]])
 		})
@@ -351,6 +988,95 @@ func checkRepositoryRegex(repo name.Repository, source resource.Source, opts ...
 	return response, nil
 }
 
+// the pre-defined OCI annotation for when an artifact was created
+const createdAnnotation = "org.opencontainers.image.created"
+
+// checkReferrers emits the artifacts which refer to the subject tag, in the
+// order of their creation annotation. The tag schema is used as a fallback
+// by remote.Referrers for registries without the referrers API.
+func checkReferrers(repo name.Repository, source resource.Source, from *resource.Version, opts ...remote.Option) (resource.CheckResponse, error) {
+	tag := repo.Tag(source.ReferrersOf.Tag.String())
+
+	subject, found, err := headOrGet(tag, opts...)
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("get subject digest: %w", err)
+	}
+
+	if !found {
+		return resource.CheckResponse{}, nil
+	}
+
+	referrers, err := remote.Referrers(repo.Digest(subject.String()), opts...)
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("get referrers: %w", err)
+	}
+
+	index, err := referrers.IndexManifest()
+	if err != nil {
+		return resource.CheckResponse{}, fmt.Errorf("get referrers manifest: %w", err)
+	}
+
+	var descs []v1.Descriptor
+	for _, desc := range index.Manifests {
+		if len(source.ReferrersOf.ArtifactTypes) > 0 && !slices.Contains(source.ReferrersOf.ArtifactTypes, desc.ArtifactType) {
+			continue
+		}
+
+		if desc.Annotations == nil {
+			// not all registries copy annotations into the referrers list
+			desc.Annotations, err = manifestAnnotations(repo.Digest(desc.Digest.String()), opts...)
+			if err != nil {
+				return resource.CheckResponse{}, fmt.Errorf("get annotations of %s: %w", desc.Digest, err)
+			}
+		}
+
+		descs = append(descs, desc)
+	}
+
+	// artifacts without the annotation sort first, in the order listed
+	sort.SliceStable(descs, func(i, j int) bool {
+		return descs[i].Annotations[createdAnnotation] < descs[j].Annotations[createdAnnotation]
+	})
+
+	response := resource.CheckResponse{}
+	for _, desc := range descs {
+		if from != nil && desc.Digest.String() == from.Digest {
+			// only emit the 'from' version and those after it
+			response = resource.CheckResponse{}
+		}
+
+		response = append(response, resource.Version{
+			Tag:    tag.TagStr(),
+			Digest: desc.Digest.String(),
+		})
+	}
+
+	return response, nil
+}
+
+func manifestAnnotations(ref name.Reference, opts ...remote.Option) (map[string]string, error) {
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseAnnotations(desc.Manifest)
+}
+
+// parseAnnotations returns the annotations of an image manifest or index.
+func parseAnnotations(manifest []byte) (map[string]string, error) {
+	var annotated struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+
+	err := json.Unmarshal(manifest, &annotated)
+	if err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+
+	return annotated.Annotations, nil
+}
+
 type TagVersion struct {
 	TagName string
 	Digest  string
@@ -0,0 +1,130 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// as with Linux's MAXSYMLINKS
+const maxSymlinks = 40
+
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// confinedName cleans the name of a tar entry, rejecting names which climb
+// out of the root. Leading slashes are taken to be relative to the root.
+func confinedName(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimLeft(filepath.ToSlash(name), "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%s: path escapes the rootfs", name)
+	}
+
+	return cleaned, nil
+}
+
+// whiteoutTarget returns the name of the file removed by a whiteout, which
+// must be a sibling of the whiteout rather than the directory it is in or
+// anything above it.
+func whiteoutTarget(whiteout string) (string, error) {
+	removed := strings.TrimPrefix(path.Base(whiteout), whiteoutPrefix)
+	if removed == "" || removed == "." || removed == ".." || strings.ContainsAny(removed, `/\`) {
+		return "", fmt.Errorf("%s: invalid whiteout", whiteout)
+	}
+
+	return confinedName(path.Join(path.Dir(whiteout), removed))
+}
+
+// resolveInRoot resolves the symlinks in a path as if root were the root of
+// the filesystem, like openat2's RESOLVE_IN_ROOT: absolute symlinks are
+// relative to root, and ".." at root stays at root. Components which don't
+// exist are left as they are.
+//
+// The result is relative to root and has no symlinks in it, so that nothing
+// done to it leaves root, except for following the final component if it
+// is created as a symlink.
+func resolveInRoot(root string, name string) (string, error) {
+	return resolveSymlinks(name, func(name string) (string, bool, error) {
+		fullPath := filepath.Join(root, filepath.FromSlash(name))
+
+		fi, err := os.Lstat(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", false, nil
+			}
+
+			return "", false, err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return "", false, nil
+		}
+
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return "", false, err
+		}
+
+		return filepath.ToSlash(target), true, nil
+	})
+}
+
+// resolveSymlinks resolves a path relative to a root in which readlink
+// returns the target of each symlink, with the semantics of resolveInRoot.
+func resolveSymlinks(name string, readlink func(string) (string, bool, error)) (string, error) {
+	resolved := "."
+	remaining := filepath.ToSlash(name)
+	symlinks := 0
+
+	for remaining != "" {
+		var component string
+		component, remaining, _ = strings.Cut(remaining, "/")
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, component)
+
+		target, isSymlink, err := readlink(next)
+		if err != nil {
+			return "", err
+		}
+
+		if !isSymlink {
+			resolved = next
+			continue
+		}
+
+		symlinks++
+		if symlinks > maxSymlinks {
+			return "", fmt.Errorf("%s: %w", name, errTooManySymlinks)
+		}
+
+		if path.IsAbs(target) {
+			resolved = "."
+		}
+
+		remaining = target + "/" + remaining
+	}
+
+	return resolved, nil
+}
+
+// resolveParentInRoot resolves the parent directory of the name within root,
+// leaving the final component as it is, so that it can be created, replaced
+// or removed rather than followed.
+func resolveParentInRoot(root string, name string) (string, error) {
+	dir, err := resolveInRoot(root, path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, path.Base(name)), nil
+}
@@ -0,0 +1,283 @@
+package commands
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// annotation on each signature layer holding the base64 signature of the
+	// layer's payload
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// artifact type of signatures attached as referrers
+	cosignSignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+)
+
+// simpleSigningPayload is the payload signed by cosign.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// filterBySignatures drops versions which lack a cosign signature by one of
+// the configured keys. Signatures are looked up by the sha256-<hex>.sig tag
+// and, if none of those verify, as referrers, and verified offline.
+func filterBySignatures(source resource.Source, response resource.CheckResponse) (resource.CheckResponse, error) {
+	keys, err := parsePublicKeys(source.VerifySignatures.PublicKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := source.NewRepository()
+	if err != nil {
+		return nil, fmt.Errorf("resolve repository: %w", err)
+	}
+
+	opts, err := source.AuthOptions(repo, []string{transport.PullScope})
+	if err != nil {
+		return nil, err
+	}
+
+	verified := resource.CheckResponse{}
+	for _, version := range response {
+		digest := repo.Digest(version.Digest)
+
+		valid := func(signatures []cosignSignature) bool {
+			for _, signature := range signatures {
+				err := verifySignature(signature, keys, version.Digest, source.VerifySignatures.Annotations)
+				if err != nil {
+					logrus.Debugf("ignoring signature of %s: %s", version.Tag, err)
+					continue
+				}
+
+				return true
+			}
+
+			return false
+		}
+
+		signatures, err := tagSignatures(digest, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("get signatures of %s: %w", version.Tag, err)
+		}
+
+		if !valid(signatures) {
+			// the signature tag may be stale or signed by other keys, while
+			// the signature is attached as a referrer
+			signatures, err = referrerSignatures(digest, opts...)
+			if err != nil {
+				return nil, fmt.Errorf("get signatures of %s: %w", version.Tag, err)
+			}
+
+			if !valid(signatures) {
+				logrus.Warnf("skipping %s: no valid signature", version.Tag)
+				continue
+			}
+		}
+
+		verified = append(verified, version)
+	}
+
+	return verified, nil
+}
+
+func parsePublicKeys(pems []string) ([]crypto.PublicKey, error) {
+	if len(pems) == 0 {
+		return nil, fmt.Errorf("verify_signatures requires at least one public key")
+	}
+
+	var keys []crypto.PublicKey
+	for _, p := range pems {
+		block, _ := pem.Decode([]byte(p))
+		if block == nil {
+			return nil, fmt.Errorf("public key is not PEM encoded")
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// cosignSignature is the payload of a signature layer with its signature.
+type cosignSignature struct {
+	Payload   []byte
+	Signature []byte
+}
+
+// tagSignatures returns the signatures of the digest from its signature
+// tag, or none if there is no such tag.
+func tagSignatures(digest name.Digest, opts ...remote.Option) ([]cosignSignature, error) {
+	sigTag := digest.Context().Tag(strings.Replace(digest.DigestStr(), ":", "-", 1) + ".sig")
+
+	img, err := remote.Image(sigTag, opts...)
+	if err != nil {
+		if checkMissingManifest(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("get signature image: %w", err)
+	}
+
+	return imageSignatures(img)
+}
+
+// referrerSignatures returns the signatures of the digest attached to it as
+// referrers.
+func referrerSignatures(digest name.Digest, opts ...remote.Option) ([]cosignSignature, error) {
+	referrers, err := remote.Referrers(digest, append(opts, remote.WithFilter("artifactType", cosignSignatureArtifactType))...)
+	if err != nil {
+		return nil, fmt.Errorf("get referrers: %w", err)
+	}
+
+	index, err := referrers.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get referrers manifest: %w", err)
+	}
+
+	var signatures []cosignSignature
+	for _, desc := range index.Manifests {
+		if desc.ArtifactType != cosignSignatureArtifactType {
+			continue
+		}
+
+		img, err := remote.Image(digest.Context().Digest(desc.Digest.String()), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("get signature image: %w", err)
+		}
+
+		sigs, err := imageSignatures(img)
+		if err != nil {
+			return nil, err
+		}
+
+		signatures = append(signatures, sigs...)
+	}
+
+	return signatures, nil
+}
+
+func imageSignatures(img v1.Image) ([]cosignSignature, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get signature manifest: %w", err)
+	}
+
+	var signatures []cosignSignature
+	for _, desc := range manifest.Layers {
+		encoded, found := desc.Annotations[cosignSignatureAnnotation]
+		if !found {
+			continue
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode signature: %w", err)
+		}
+
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("get signature layer: %w", err)
+		}
+
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, fmt.Errorf("get signature payload: %w", err)
+		}
+
+		payload, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read signature payload: %w", err)
+		}
+
+		signatures = append(signatures, cosignSignature{
+			Payload:   payload,
+			Signature: signature,
+		})
+	}
+
+	return signatures, nil
+}
+
+// verifySignature checks that the signature is by one of the keys, and that
+// its payload is for the digest and carries the required annotations.
+func verifySignature(signature cosignSignature, keys []crypto.PublicKey, digest string, annotations map[string]string) error {
+	var signed bool
+	for _, key := range keys {
+		if verifyWithKey(key, signature.Payload, signature.Signature) {
+			signed = true
+			break
+		}
+	}
+
+	if !signed {
+		return fmt.Errorf("not signed by any of the public keys")
+	}
+
+	var payload simpleSigningPayload
+	err := json.Unmarshal(signature.Payload, &payload)
+	if err != nil {
+		return fmt.Errorf("parse payload: %w", err)
+	}
+
+	if payload.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signed digest %s does not match", payload.Critical.Image.DockerManifestDigest)
+	}
+
+	for key, expected := range annotations {
+		value, found := payload.Optional[key]
+		if !found {
+			return fmt.Errorf("missing annotation %s", key)
+		}
+
+		if fmt.Sprint(value) != expected {
+			return fmt.Errorf("annotation %s is %v, not %s", key, value, expected)
+		}
+	}
+
+	return nil
+}
+
+func verifyWithKey(key crypto.PublicKey, payload []byte, signature []byte) bool {
+	hash := sha256.Sum256(payload)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, signature)
+	default:
+		return false
+	}
+}
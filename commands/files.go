@@ -0,0 +1,706 @@
+package commands
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	resource "github.com/concourse/registry-image-resource"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb"
+	"golang.org/x/sync/errgroup"
+)
+
+// extractFiles copies the paths in params.Extract out of the image into
+// dest, without unpacking a rootfs. The layers are indexed to find the final
+// version of each path, as it would be in the rootfs, and then only the
+// layers which hold their contents are read again to copy them.
+func extractFiles(dest string, img v1.Image, params resource.GetParams, cache *blobCache, debug bool, out io.Writer) error {
+	if len(params.Extract) == 0 {
+		return fmt.Errorf("no paths to extract")
+	}
+
+	err := checkDests(params.Extract)
+	if err != nil {
+		return err
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp(dest, "layers-")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	files, err := downloadLayers(tmpDir, layers, cache, debug, out)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	index := &layerIndex{}
+	for i, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return err
+		}
+
+		logrus.Debugf("indexing layer %d of %d", i+1, len(layers))
+
+		indexed, err := indexLayer(i, files[i], diffID)
+		if err != nil {
+			return err
+		}
+
+		index.layers = append(index.layers, indexed)
+	}
+
+	var copies []fileCopy
+	for _, extract := range params.Extract {
+		planned, err := index.plan(extract)
+		if err != nil {
+			return err
+		}
+
+		copies = append(copies, planned...)
+	}
+
+	return writeFiles(dest, copies, files)
+}
+
+// downloadLayers downloads all of the layers to files in dir, or in the cache
+// if there is one.
+func downloadLayers(dir string, layers []v1.Layer, cache *blobCache, debug bool, out io.Writer) ([]*os.File, error) {
+	if debug {
+		out = io.Discard
+	}
+
+	progress := mpb.New(mpb.WithOutput(out))
+
+	bars := make([]*mpb.Bar, len(layers))
+	for i, layer := range layers {
+		var err error
+		bars[i], err = newLayerBar(progress, layer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(layerDownloadConcurrency)
+
+	files := make([]*os.File, len(layers))
+	for i, layer := range layers {
+		g.Go(func() error {
+			f, err := downloadLayer(ctx, dir, layer, cache, bars[i])
+			if err != nil {
+				return err
+			}
+
+			files[i] = f
+
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+
+		return nil, err
+	}
+
+	progress.Wait()
+
+	return files, nil
+}
+
+// layerIndex holds the entries of an image's layers, bottom to top, so that
+// paths can be looked up as they would be in the rootfs.
+type layerIndex struct {
+	layers []indexedLayer
+}
+
+type indexedLayer struct {
+	entries    map[string]indexedEntry
+	whiteouts  map[string]bool
+	opaqueDirs map[string]bool
+}
+
+type indexedEntry struct {
+	name   string
+	header *tar.Header
+
+	// the layer the entry is in, and its position in the layer
+	layer    int
+	position int
+}
+
+func indexLayer(layer int, r io.Reader, diffID v1.Hash) (indexedLayer, error) {
+	indexed := indexedLayer{
+		entries:    map[string]indexedEntry{},
+		whiteouts:  map[string]bool{},
+		opaqueDirs: map[string]bool{},
+	}
+
+	dr, err := decompress(r)
+	if err != nil {
+		return indexedLayer{}, err
+	}
+
+	defer dr.Close()
+
+	hasher, err := v1.Hasher(diffID.Algorithm)
+	if err != nil {
+		return indexedLayer{}, err
+	}
+
+	uncompressed := io.TeeReader(dr, hasher)
+
+	tr := tar.NewReader(uncompressed)
+
+	for position := 0; ; position++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return indexedLayer{}, err
+		}
+
+		name, err := confinedName(hdr.Name)
+		if err != nil {
+			return indexedLayer{}, err
+		}
+
+		base := path.Base(name)
+		dir := path.Dir(name)
+
+		if base == whiteoutOpaqueDir {
+			indexed.opaqueDirs[dir] = true
+		} else if strings.HasPrefix(base, whiteoutPrefix) {
+			removed, err := whiteoutTarget(name)
+			if err != nil {
+				return indexedLayer{}, err
+			}
+
+			indexed.whiteouts[removed] = true
+		} else {
+			// later entries replace earlier ones, as when extracting
+			indexed.entries[name] = indexedEntry{
+				name:     name,
+				header:   hdr,
+				layer:    layer,
+				position: position,
+			}
+		}
+	}
+
+	_, err = io.Copy(io.Discard, uncompressed)
+	if err != nil {
+		return indexedLayer{}, err
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != diffID.Hex {
+		return indexedLayer{}, fmt.Errorf("layer diff ID mismatch: expected %s, got %s:%s", diffID, diffID.Algorithm, actual)
+	}
+
+	return indexed, nil
+}
+
+// lookup returns the topmost entry for the name which isn't hidden by a
+// whiteout, an opaque directory or a non-directory at a parent path in a
+// layer above it. Symlinks are not followed.
+func (index *layerIndex) lookup(name string) (indexedEntry, bool) {
+	var parents []string
+	if name != "." {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			parents = append(parents, dir)
+		}
+
+		// the root may be opaque too
+		parents = append(parents, ".")
+	}
+
+	for i := len(index.layers) - 1; i >= 0; i-- {
+		layer := index.layers[i]
+
+		entry, found := layer.entries[name]
+		if found {
+			return entry, true
+		}
+
+		if layer.whiteouts[name] {
+			return indexedEntry{}, false
+		}
+
+		for _, parent := range parents {
+			if layer.whiteouts[parent] || layer.opaqueDirs[parent] {
+				return indexedEntry{}, false
+			}
+
+			entry, found := layer.entries[parent]
+			if found && entry.header.Typeflag != tar.TypeDir {
+				return indexedEntry{}, false
+			}
+		}
+	}
+
+	return indexedEntry{}, false
+}
+
+// resolve follows the symlinks in the name, including its final component,
+// within the image's root.
+func (index *layerIndex) resolve(name string) (string, error) {
+	return resolveSymlinks(name, func(name string) (string, bool, error) {
+		entry, found := index.lookup(name)
+		if !found || entry.header.Typeflag != tar.TypeSymlink {
+			return "", false, nil
+		}
+
+		return entry.header.Linkname, true, nil
+	})
+}
+
+// within returns the entries under the directory, sorted by name.
+func (index *layerIndex) within(dir string) []indexedEntry {
+	names := map[string]bool{}
+	for _, layer := range index.layers {
+		for name := range layer.entries {
+			if name != "." && (dir == "." || strings.HasPrefix(name, dir+"/")) {
+				names[name] = true
+			}
+		}
+	}
+
+	var entries []indexedEntry
+	for name := range names {
+		entry, found := index.lookup(name)
+		if found {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	return entries
+}
+
+// contents returns the entry holding the contents of a regular file or
+// hardlink, which for a hardlink is the file it links to.
+func (index *layerIndex) contents(entry indexedEntry) (indexedEntry, error) {
+	for range maxSymlinks {
+		switch entry.header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			return entry, nil
+		case tar.TypeLink:
+		default:
+			return indexedEntry{}, fmt.Errorf("%s: not a regular file", entry.header.Name)
+		}
+
+		linkname, err := confinedName(entry.header.Linkname)
+		if err != nil {
+			return indexedEntry{}, fmt.Errorf("%s: hardlink to %s escapes the rootfs", entry.header.Name, entry.header.Linkname)
+		}
+
+		// the file linked to should be earlier in the same layer
+		target, found := index.layers[entry.layer].entries[linkname]
+		if !found {
+			target, found = index.lookup(linkname)
+		}
+
+		if !found {
+			return indexedEntry{}, fmt.Errorf("%s: hardlink to missing file %s", entry.header.Name, entry.header.Linkname)
+		}
+
+		entry = target
+	}
+
+	return indexedEntry{}, fmt.Errorf("%s: too many levels of hardlinks", entry.header.Name)
+}
+
+// extractDest returns the cleaned dest of an extracted path, relative to the
+// output.
+func extractDest(extract resource.ExtractPath) (string, error) {
+	dest := extract.Dest
+	if dest == "" {
+		dest = path.Base(path.Clean("/" + extract.Src))
+	}
+
+	cleaned, err := confinedName(dest)
+	if err != nil {
+		return "", fmt.Errorf("%s: dest escapes the output", extract.Dest)
+	}
+
+	return cleaned, nil
+}
+
+// versionFiles are written alongside the extracted paths by saveVersionInfo.
+var versionFiles = []string{"digest", "tag", "repository", "base_digest"}
+
+// checkDests rejects extracted paths whose dests are the same or within one
+// another, as what's written for one could then redirect the other, e.g.
+// through a symlink. Dests also must not hold the files describing the
+// version, which would overwrite them.
+func checkDests(extracts []resource.ExtractPath) error {
+	dests := make([]string, len(extracts))
+	for i, extract := range extracts {
+		var err error
+		dests[i], err = extractDest(extract)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range versionFiles {
+			if isWithin(file, dests[i]) || isWithin(dests[i], file) {
+				return fmt.Errorf("dest %s overlaps the version's %s file", dests[i], file)
+			}
+		}
+
+		for _, other := range dests[:i] {
+			if isWithin(dests[i], other) || isWithin(other, dests[i]) {
+				return fmt.Errorf("dests %s and %s overlap", other, dests[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// isWithin returns whether the name is the dir or inside it.
+func isWithin(name string, dir string) bool {
+	return dir == "." || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// fileCopy is a path to write from the image.
+type fileCopy struct {
+	// relative to the output
+	dest string
+
+	// the header of the entry, or nil for a directory with no entry of its
+	// own
+	header *tar.Header
+
+	// for regular files, the entry holding the contents
+	contents indexedEntry
+}
+
+// plan returns what to write for an extracted path: the file it resolves to,
+// or the directory and everything within it.
+func (index *layerIndex) plan(extract resource.ExtractPath) ([]fileCopy, error) {
+	src, err := confinedName(extract.Src)
+	if err != nil {
+		return nil, err
+	}
+
+	dest, err := extractDest(extract)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := index.resolve(src)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, found := index.lookup(resolved)
+	if found && entry.header.Typeflag != tar.TypeDir {
+		file, ok, err := index.fileCopy(dest, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("%s: not a regular file, directory or symlink", extract.Src)
+		}
+
+		return []fileCopy{file}, nil
+	}
+
+	// directories may only be implied by the paths within them
+	within := index.within(resolved)
+	if !found && resolved != "." && len(within) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory in the image", extract.Src)
+	}
+
+	copies := []fileCopy{{dest: dest, header: entry.header}}
+	for _, entry := range within {
+		rel := entry.name
+		if resolved != "." {
+			rel = strings.TrimPrefix(entry.name, resolved+"/")
+		}
+
+		file, ok, err := index.fileCopy(path.Join(dest, rel), entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			copies = append(copies, file)
+		}
+	}
+
+	return copies, nil
+}
+
+func (index *layerIndex) fileCopy(dest string, entry indexedEntry) (fileCopy, bool, error) {
+	file := fileCopy{
+		dest:   dest,
+		header: entry.header,
+	}
+
+	switch entry.header.Typeflag {
+	case tar.TypeDir, tar.TypeSymlink:
+		return file, true, nil
+	case tar.TypeReg, tar.TypeRegA, tar.TypeLink:
+		contents, err := index.contents(entry)
+		if err != nil {
+			return fileCopy{}, false, err
+		}
+
+		file.contents = contents
+
+		return file, true, nil
+	default:
+		logrus.Debugf("skipping special file %s", entry.name)
+		return fileCopy{}, false, nil
+	}
+}
+
+// fileWrite is a file to write with the contents of a layer entry, at a
+// name relative to the output.
+type fileWrite struct {
+	name string
+	mode os.FileMode
+}
+
+// writeFiles writes the copies into dest, reading the contents of files from
+// the layers which hold them.
+func writeFiles(dest string, copies []fileCopy, layers []*os.File) error {
+	// write directories before what's in them
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].dest < copies[j].dest
+	})
+
+	// the files to write from each layer, by the position of their contents
+	writes := map[int]map[int][]fileWrite{}
+
+	type dirMode struct {
+		name string
+		mode os.FileMode
+	}
+
+	var dirModes []dirMode
+
+	for _, file := range copies {
+		// symlinks written earlier are followed within dest
+		fullPath, err := outputPath(dest, file.dest)
+		if err != nil {
+			return err
+		}
+
+		logrus.Debugf("writing %s", fullPath)
+
+		if file.header == nil || file.header.Typeflag == tar.TypeDir {
+			err := os.MkdirAll(fullPath, 0755)
+			if err != nil {
+				return err
+			}
+
+			if file.header != nil && file.dest != "." {
+				dirModes = append(dirModes, dirMode{file.dest, file.header.FileInfo().Mode().Perm()})
+			}
+
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(fullPath), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.RemoveAll(fullPath)
+		if err != nil {
+			return err
+		}
+
+		if file.header.Typeflag == tar.TypeSymlink {
+			err := os.Symlink(file.header.Linkname, fullPath)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		contents := file.contents
+		if writes[contents.layer] == nil {
+			writes[contents.layer] = map[int][]fileWrite{}
+		}
+
+		writes[contents.layer][contents.position] = append(writes[contents.layer][contents.position], fileWrite{
+			name: file.dest,
+			mode: contents.header.FileInfo().Mode().Perm(),
+		})
+	}
+
+	for layer, positions := range writes {
+		err := writeFromLayer(dest, layers[layer], positions)
+		if err != nil {
+			return err
+		}
+	}
+
+	// after writing what's in them, in case they aren't writable
+	for i := len(dirModes) - 1; i >= 0; i-- {
+		dirPath, err := outputPath(dest, dirModes[i].name)
+		if err != nil {
+			return err
+		}
+
+		// chmod follows symlinks, so make sure it's still the directory
+		fi, err := os.Lstat(dirPath)
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			continue
+		}
+
+		err = os.Chmod(dirPath, dirModes[i].mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFromLayer writes files with the contents of the entries at the
+// positions in the layer.
+func writeFromLayer(dest string, layer *os.File, positions map[int][]fileWrite) error {
+	_, err := layer.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	dr, err := decompress(layer)
+	if err != nil {
+		return err
+	}
+
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+
+	remaining := len(positions)
+	for position := 0; remaining > 0; position++ {
+		_, err := tr.Next()
+		if err != nil {
+			return err
+		}
+
+		writes, found := positions[position]
+		if !found {
+			continue
+		}
+
+		first := writes[0]
+
+		firstPath, err := writeFile(dest, first.name, first.mode, tr)
+		if err != nil {
+			return err
+		}
+
+		// the same contents written elsewhere are copied from the first
+		for _, write := range writes[1:] {
+			src, err := os.Open(firstPath)
+			if err != nil {
+				return err
+			}
+
+			_, err = writeFile(dest, write.name, write.mode, src)
+			src.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		remaining--
+	}
+
+	return nil
+}
+
+// writeFile writes a new file at the name in dest, replacing whatever is
+// there without following it if it's a symlink, and returns its path.
+func writeFile(dest string, name string, mode os.FileMode, r io.Reader) (string, error) {
+	filePath, err := outputPath(dest, name)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.RemoveAll(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// O_EXCL fails rather than following a symlink created in the meantime
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return "", err
+	}
+
+	// not affected by the umask, unlike the mode when creating it
+	err = f.Chmod(mode)
+	if err != nil {
+		return "", err
+	}
+
+	return filePath, f.Close()
+}
+
+// outputPath resolves the name within dest, following any symlinks in its
+// parent directories within dest.
+func outputPath(dest string, name string) (string, error) {
+	resolved, err := resolveParentInRoot(dest, name)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dest, filepath.FromSlash(resolved)), nil
+}
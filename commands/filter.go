@@ -0,0 +1,115 @@
+package commands
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathFilter selects which entries of the layers to extract, by glob
+// patterns matched against their paths within the rootfs. A pattern
+// matching a directory selects everything within it.
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+func newPathFilter(include []string, exclude []string) (*pathFilter, error) {
+	filter := &pathFilter{}
+
+	for _, pattern := range include {
+		cleaned, err := cleanPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		filter.include = append(filter.include, cleaned)
+	}
+
+	for _, pattern := range exclude {
+		cleaned, err := cleanPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		filter.exclude = append(filter.exclude, cleaned)
+	}
+
+	return filter, nil
+}
+
+func cleanPattern(pattern string) (string, error) {
+	cleaned := path.Clean(strings.TrimLeft(pattern, "/"))
+
+	_, err := path.Match(cleaned, "")
+	if err != nil {
+		return "", fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+	}
+
+	return cleaned, nil
+}
+
+// Selects returns whether to extract the entry with the (cleaned) name.
+// Directories which may contain included paths are selected too, so that
+// they are created with their own metadata.
+func (f *pathFilter) Selects(name string, isDir bool) bool {
+	if name == "." {
+		return true
+	}
+
+	for _, pattern := range f.exclude {
+		if matchesOrWithin(pattern, name) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.include {
+		if matchesOrWithin(pattern, name) {
+			return true
+		}
+
+		if isDir && mayContainMatches(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesOrWithin returns whether the pattern matches the name or one of
+// its parent directories.
+func matchesOrWithin(pattern string, name string) bool {
+	components := strings.Split(name, "/")
+	for i := range components {
+		matched, _ := path.Match(pattern, strings.Join(components[:i+1], "/"))
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mayContainMatches returns whether the directory may contain paths
+// matching the pattern.
+func mayContainMatches(pattern string, dir string) bool {
+	patternComponents := strings.Split(pattern, "/")
+	dirComponents := strings.Split(dir, "/")
+
+	if len(dirComponents) >= len(patternComponents) {
+		return false
+	}
+
+	for i, component := range dirComponents {
+		matched, _ := path.Match(patternComponents[i], component)
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
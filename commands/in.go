@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	resource "github.com/concourse/registry-image-resource"
 	"github.com/fatih/color"
@@ -14,12 +19,81 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/sirupsen/logrus"
 )
 
+// ImageMetadata is the image's runtime configuration. Concourse reads env and
+// user when running a task with the image; the rest is for tasks which want
+// to run it the way its entrypoint expects.
 type ImageMetadata struct {
 	Env  []string `json:"env"`
 	User string   `json:"user"`
+
+	WorkingDir   string               `json:"working_dir,omitempty"`
+	Entrypoint   []string             `json:"entrypoint,omitempty"`
+	Cmd          []string             `json:"cmd,omitempty"`
+	ExposedPorts []string             `json:"exposed_ports,omitempty"`
+	Volumes      []string             `json:"volumes,omitempty"`
+	StopSignal   string               `json:"stop_signal,omitempty"`
+	Healthcheck  *HealthcheckMetadata `json:"healthcheck,omitempty"`
+}
+
+type HealthcheckMetadata struct {
+	Test        []string `json:"test,omitempty"`
+	Interval    string   `json:"interval,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+	StartPeriod string   `json:"start_period,omitempty"`
+	Retries     int      `json:"retries,omitempty"`
+}
+
+func newImageMetadata(cfg v1.Config) ImageMetadata {
+	meta := ImageMetadata{
+		Env:  cfg.Env,
+		User: cfg.User,
+
+		WorkingDir:   cfg.WorkingDir,
+		Entrypoint:   cfg.Entrypoint,
+		Cmd:          cfg.Cmd,
+		ExposedPorts: sortedKeys(cfg.ExposedPorts),
+		Volumes:      sortedKeys(cfg.Volumes),
+		StopSignal:   cfg.StopSignal,
+	}
+
+	if cfg.Healthcheck != nil {
+		meta.Healthcheck = &HealthcheckMetadata{
+			Test:        cfg.Healthcheck.Test,
+			Interval:    durationString(cfg.Healthcheck.Interval),
+			Timeout:     durationString(cfg.Healthcheck.Timeout),
+			StartPeriod: durationString(cfg.Healthcheck.StartPeriod),
+			Retries:     cfg.Healthcheck.Retries,
+		}
+	}
+
+	return meta
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+
+	return d.String()
 }
 
 type In struct {
@@ -64,6 +138,31 @@ func (i *In) Execute() error {
 
 	dest := i.args[1]
 
+	switch req.Params.Xattrs() {
+	case resource.XattrsSkip, resource.XattrsWarn, resource.XattrsFail:
+	default:
+		return fmt.Errorf("unknown xattrs policy %q: must be %s, %s or %s", req.Params.RawXattrs, resource.XattrsSkip, resource.XattrsWarn, resource.XattrsFail)
+	}
+
+	platforms, err := req.Params.ParsePlatforms()
+	if err != nil {
+		return err
+	}
+
+	if len(platforms) > 0 && req.Params.Format() == OciLayoutFormatName {
+		return fmt.Errorf("platforms cannot be used with the %s format, which includes every platform", OciLayoutFormatName)
+	}
+
+	if req.Version.Repository != "" {
+		// the version was found in one of multiple configured repositories
+		if !slices.Contains(req.Source.CheckedRepositories(), req.Version.Repository) {
+			return fmt.Errorf("version repository %s is not configured in source", req.Version.Repository)
+		}
+
+		req.Source.Repository = req.Version.Repository
+		req.Source.Repositories = nil
+	}
+
 	if req.Source.AwsRegion != "" {
 		if !req.Source.AuthenticateToECR() {
 			return fmt.Errorf("cannot authenticate with ECR")
@@ -77,27 +176,60 @@ func (i *In) Execute() error {
 
 	tag := repo.Tag(req.Version.Tag)
 
+	if req.Source.ContentTrust != nil && req.Source.ContentTrust.Verify {
+		err := verifyTrustedVersion(req.Source, tag, req.Version)
+		if err != nil {
+			return fmt.Errorf("content trust verification failed: %w", err)
+		}
+	}
+
 	if !req.Params.SkipDownload {
-		mirrorSource, hasMirror, err := req.Source.Mirror()
+		origin, err := req.Source.Rewrite()
+		if err != nil {
+			return fmt.Errorf("failed to rewrite repository: %w", err)
+		}
+
+		mirrors, err := origin.Mirrors()
 		if err != nil {
 			return fmt.Errorf("failed to resolve mirror: %w", err)
 		}
 
 		usedMirror := false
-		if hasMirror {
-			err := downloadWithRetry(tag, mirrorSource, req.Params, req.Version, dest, i.stderr)
-			if err != nil {
-				logrus.Warnf("download from mirror %s failed: %s", mirrorSource.Repository, err)
-			} else {
-				usedMirror = true
+		var failedMirrors []resource.MirrorSource
+		for _, mirror := range mirrors {
+			err := verifyMirrorDigest(mirror, req.Version)
+			if err != nil && mirror.Mirror.Verify == resource.MirrorVerifyFail {
+				return err
 			}
+
+			if err == nil {
+				err = downloadWithRetry(tag, mirror.Source, req.Params, req.Version, dest, i.stderr)
+				if err == nil {
+					usedMirror = true
+					break
+				}
+			}
+
+			if mirror.Mirror.Fatal {
+				return fmt.Errorf("download from mirror %s failed: %w", mirror.Repository, err)
+			}
+
+			logrus.Warnf("download from mirror %s failed: %s", mirror.Repository, err)
+
+			failedMirrors = append(failedMirrors, mirror)
 		}
 
 		if !usedMirror {
-			err := downloadWithRetry(tag, req.Source, req.Params, req.Version, dest, i.stderr)
+			err := downloadWithRetry(tag, origin, req.Params, req.Version, dest, i.stderr)
 			if err != nil {
 				return fmt.Errorf("download failed: %w", err)
 			}
+
+			for _, mirror := range failedMirrors {
+				if mirror.Mirror.Populate {
+					populateMirror(origin, mirror, req.Version)
+				}
+			}
 		}
 	}
 
@@ -128,6 +260,19 @@ func downloadWithRetry(tag name.Tag, source resource.Source, params resource.Get
 		return fmt.Errorf("resolve repository name: %w", err)
 	}
 
+	var cache *blobCache
+	if source.CacheDir != "" {
+		cache, err = newBlobCache(source.CacheDir, source.CacheMaxSizeMB)
+		if err != nil {
+			return err
+		}
+	}
+
+	platforms, err := params.ParsePlatforms()
+	if err != nil {
+		return err
+	}
+
 	return resource.RetryOnRateLimit(func() error {
 		opts, err := source.AuthOptions(repo, []string{transport.PullScope})
 		if err != nil {
@@ -158,13 +303,24 @@ func downloadWithRetry(tag name.Tag, source resource.Source, params resource.Get
 			return nil
 		}
 
+		if len(platforms) > 0 {
+			for _, platform := range platforms {
+				err := savePlatformImage(repo.Digest(version.Digest), platform, dest, tag, params, cache, source.Debug, stderr, opts)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
 		// else fallback to current behavior
 		image, err := remote.Image(repo.Digest(version.Digest), opts...)
 		if err != nil {
 			return fmt.Errorf("get image: %w", err)
 		}
 
-		err = saveImage(dest, tag, image, params.Format(), source.Debug, stderr)
+		err = saveImage(dest, tag, image, params, cache, source.Debug, stderr)
 		if err != nil {
 			return fmt.Errorf("save image: %w", err)
 		}
@@ -173,18 +329,213 @@ func downloadWithRetry(tag name.Tag, source resource.Source, params resource.Get
 	})
 }
 
-func saveImage(dest string, tag name.Tag, image v1.Image, format string, debug bool, stderr io.Writer) error {
-	switch format {
+// savePlatformImage saves the image for the platform into a directory named
+// after it, e.g. linux-arm64-v8.
+func savePlatformImage(ref name.Digest, platform v1.Platform, dest string, tag name.Tag, params resource.GetParams, cache *blobCache, debug bool, stderr io.Writer, opts []remote.Option) error {
+	fmt.Fprintf(os.Stderr, "fetching %s image\n", color.CyanString(platform.String()))
+
+	desc, err := remote.Get(ref, append(opts, remote.WithPlatform(platform))...)
+	if err != nil {
+		return fmt.Errorf("get %s image: %w", platform, err)
+	}
+
+	image, err := desc.Image()
+	if err != nil {
+		return fmt.Errorf("get %s image: %w", platform, err)
+	}
+
+	// the image of an index is picked by the platform of its descriptor,
+	// but a digest of a single image is fetched whatever the platform, so
+	// make sure that it's the one asked for
+	if !desc.MediaType.IsIndex() {
+		cfg, err := image.ConfigFile()
+		if err != nil {
+			return fmt.Errorf("get %s image config: %w", platform, err)
+		}
+
+		imagePlatform := cfg.Platform()
+		if imagePlatform == nil || !imagePlatform.Satisfies(platform) {
+			return fmt.Errorf("no image for platform %s: image is for %s", platform, imagePlatform)
+		}
+	}
+
+	platformDest := filepath.Join(dest, platformDir(platform))
+
+	err = os.MkdirAll(platformDest, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = saveImage(platformDest, tag, image, params, cache, debug, stderr)
+	if err != nil {
+		return fmt.Errorf("save %s image: %w", platform, err)
+	}
+
+	return nil
+}
+
+func platformDir(platform v1.Platform) string {
+	parts := []string{platform.OS, platform.Architecture}
+	if platform.Variant != "" {
+		parts = append(parts, platform.Variant)
+	}
+
+	return strings.Join(parts, "-")
+}
+
+// verifyMirrorDigest refuses to use a mirror whose manifest for the version
+// has a different digest than requested, or which cannot be verified. A
+// mirror which doesn't have the version is left for the download to report.
+func verifyMirrorDigest(mirror resource.MirrorSource, version resource.Version) error {
+	if mirror.Mirror.Verify == "" {
+		return nil
+	}
+
+	repo, err := mirror.NewRepository()
+	if err != nil {
+		return fmt.Errorf("cannot verify mirror %s: %w", mirror.Repository, err)
+	}
+
+	rt, err := mirror.Transport(repo, []string{transport.PullScope})
+	if err != nil {
+		return fmt.Errorf("cannot verify mirror %s: %w", mirror.Repository, err)
+	}
+
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", repo.RepositoryStr(), version.Digest),
+	}
+
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("cannot verify mirror %s: %w", mirror.Repository, err)
+	}
+
+	req.Header.Set("Accept", strings.Join([]string{
+		string(types.OCIImageIndex),
+		string(types.OCIManifestSchema1),
+		string(types.DockerManifestList),
+		string(types.DockerManifestSchema2),
+	}, ","))
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot verify mirror %s: %w", mirror.Repository, err)
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("cannot verify mirror %s: HEAD %s: %s", mirror.Repository, version.Digest, resp.Status)
+	}
+
+	served := resp.Header.Get("Docker-Content-Digest")
+	if served == "" {
+		return fmt.Errorf("cannot verify mirror %s: no digest served for %s", mirror.Repository, version.Digest)
+	}
+
+	if served != version.Digest {
+		return fmt.Errorf("mirror %s serves %s when asked for %s", mirror.Repository, served, version.Digest)
+	}
+
+	return nil
+}
+
+// populateMirror copies the version from the origin into a mirror, so that
+// the mirror can serve it next time. The mirror's tag is only updated if the
+// origin's tag still points to the version. It is best-effort; failures are
+// only logged.
+func populateMirror(origin resource.Source, mirror resource.MirrorSource, version resource.Version) {
+	logrus.Infof("populating mirror %s with %s", mirror.Repository, version.Digest)
+
+	err := resource.RetryOnRateLimit(func() error {
+		return copyImage(origin, mirror.Source, version)
+	})
+	if err != nil {
+		logrus.Warnf("populating mirror %s failed: %s", mirror.Repository, err)
+	}
+}
+
+func copyImage(from resource.Source, to resource.Source, version resource.Version) error {
+	fromRepo, err := from.NewRepository()
+	if err != nil {
+		return fmt.Errorf("resolve repository name: %w", err)
+	}
+
+	fromOpts, err := from.AuthOptions(fromRepo, []string{transport.PullScope})
+	if err != nil {
+		return err
+	}
+
+	desc, err := remote.Get(fromRepo.Digest(version.Digest), fromOpts...)
+	if err != nil {
+		return fmt.Errorf("remote get: %w", err)
+	}
+
+	toRepo, err := to.NewRepository()
+	if err != nil {
+		return fmt.Errorf("resolve repository name: %w", err)
+	}
+
+	toOpts, err := to.AuthOptions(toRepo, []string{transport.PushScope})
+	if err != nil {
+		return err
+	}
+
+	// only move the mirror's tag if it is still the origin's tag for the
+	// version; an older version, or an artifact referring to the tag, is
+	// pushed by digest alone
+	var ref name.Reference = toRepo.Digest(version.Digest)
+	if version.Tag != "" {
+		current, found, err := headOrGet(fromRepo.Tag(version.Tag), fromOpts...)
+		if err != nil {
+			return fmt.Errorf("resolve tag %s: %w", version.Tag, err)
+		}
+
+		if found && current.String() == version.Digest {
+			ref = toRepo.Tag(version.Tag)
+		}
+	}
+
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return fmt.Errorf("image index: %w", err)
+		}
+
+		return remote.WriteIndex(ref, index, toOpts...)
+	}
+
+	image, err := desc.Image()
+	if err != nil {
+		return fmt.Errorf("image: %w", err)
+	}
+
+	return remote.Write(ref, image, toOpts...)
+}
+
+func saveImage(dest string, tag name.Tag, image v1.Image, params resource.GetParams, cache *blobCache, debug bool, stderr io.Writer) error {
+	switch params.Format() {
 	case "oci":
 		err := ociFormat(dest, tag, image)
 		if err != nil {
 			return fmt.Errorf("write oci image: %w", err)
 		}
 	case "rootfs":
-		err := rootfsFormat(dest, image, debug, stderr)
+		err := rootfsFormat(dest, image, params, cache, debug, stderr)
 		if err != nil {
 			return fmt.Errorf("write rootfs: %w", err)
 		}
+	case "files":
+		err := extractFiles(dest, image, params, cache, debug, stderr)
+		if err != nil {
+			return fmt.Errorf("extract files: %w", err)
+		}
 	}
 
 	return nil
@@ -206,6 +557,13 @@ func saveVersionInfo(dest string, version resource.Version, repo string) error {
 		return fmt.Errorf("write image repository: %w", err)
 	}
 
+	if version.BaseDigest != "" {
+		err = os.WriteFile(filepath.Join(dest, "base_digest"), []byte(version.BaseDigest), 0644)
+		if err != nil {
+			return fmt.Errorf("write base image digest: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -228,8 +586,8 @@ func ociFormat(dest string, tag name.Tag, image v1.Image) error {
 	return nil
 }
 
-func rootfsFormat(dest string, image v1.Image, debug bool, stderr io.Writer) error {
-	err := unpackImage(filepath.Join(dest, "rootfs"), image, debug, stderr)
+func rootfsFormat(dest string, image v1.Image, params resource.GetParams, cache *blobCache, debug bool, stderr io.Writer) error {
+	err := unpackImage(filepath.Join(dest, "rootfs"), image, params, cache, debug, stderr)
 	if err != nil {
 		return fmt.Errorf("extract image: %w", err)
 	}
@@ -244,14 +602,7 @@ func rootfsFormat(dest string, image v1.Image, debug bool, stderr io.Writer) err
 		return fmt.Errorf("create image metadata: %w", err)
 	}
 
-	env := cfg.Config.Env
-
-	user := cfg.Config.User
-
-	err = json.NewEncoder(meta).Encode(ImageMetadata{
-		Env:  env,
-		User: user,
-	})
+	err = json.NewEncoder(meta).Encode(newImageMetadata(cfg.Config))
 	if err != nil {
 		return fmt.Errorf("write image metadata: %w", err)
 	}
@@ -261,6 +612,11 @@ func rootfsFormat(dest string, image v1.Image, debug bool, stderr io.Writer) err
 		return fmt.Errorf("close image metadata file: %w", err)
 	}
 
+	err = writeEnv(dest, cfg.Config.Env)
+	if err != nil {
+		return err
+	}
+
 	err = writeLabels(dest, cfg.Config.Labels)
 	if err != nil {
 		return err
@@ -269,6 +625,45 @@ func rootfsFormat(dest string, image v1.Image, debug bool, stderr io.Writer) err
 	return nil
 }
 
+// writeEnv writes the image's environment as a file of exports which can be
+// sourced by a shell.
+func writeEnv(dest string, env []string) error {
+	var script strings.Builder
+	for _, kv := range env {
+		key, value, found := strings.Cut(kv, "=")
+		if !found || !isShellName(key) {
+			logrus.Warnf("skipping env var %q, which can't be exported by a shell", kv)
+			continue
+		}
+
+		fmt.Fprintf(&script, "export %s='%s'\n", key, strings.ReplaceAll(value, "'", `'\''`))
+	}
+
+	err := os.WriteFile(filepath.Join(dest, "env"), []byte(script.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("write image env: %w", err)
+	}
+
+	return nil
+}
+
+func isShellName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && c >= '0' && c <= '9':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
 func writeLabels(dest string, labelData map[string]string) error {
 	if labelData == nil {
 		labelData = map[string]string{}
@@ -69,6 +69,22 @@ func (o *Out) Execute() error {
 		}
 	}
 
+	if req.Params.ECRCreateRepository != nil {
+		if req.Source.AwsRegion == "" {
+			return fmt.Errorf("ecr_create_repository is only supported for ECR repositories")
+		}
+
+		lifecyclePolicy, err := req.Params.ParseLifecyclePolicy(src)
+		if err != nil {
+			return fmt.Errorf("could not read lifecycle policy: %w", err)
+		}
+
+		err = req.Source.CreateECRRepository(*req.Params.ECRCreateRepository, lifecyclePolicy)
+		if err != nil {
+			return fmt.Errorf("could not create ECR repository: %w", err)
+		}
+	}
+
 	tagsToPush := []name.Tag{}
 
 	repo, err := req.Source.NewRepository()
@@ -257,7 +273,7 @@ func signImages(req resource.OutRequest, img v1.Image, tags []name.Tag) error {
 	}
 
 	for _, tag := range tags {
-		trustedRepo, err := gcr.NewTrustedGcrRepository(notaryConfigDir, tag, createRegistryAuth(req), createNotaryAuth(req))
+		trustedRepo, err := gcr.NewTrustedGcrRepository(notaryConfigDir, tag, createRegistryAuth(req.Source), createNotaryAuth(req.Source))
 		if err != nil {
 			return fmt.Errorf("create TrustedGcrRepository: %w", err)
 		}
@@ -275,41 +291,48 @@ func signImages(req resource.OutRequest, img v1.Image, tags []name.Tag) error {
 
 // It's okay if both are blank. It will become an Anonymous Authenticator in
 // that case.
-func createRegistryAuth(req resource.OutRequest) *authn.Basic {
+func createRegistryAuth(source resource.Source) *authn.Basic {
 	return &authn.Basic{
-		Username: req.Source.Username,
-		Password: req.Source.Password,
+		Username: source.Username,
+		Password: source.Password,
 	}
 }
 
-func createNotaryAuth(req resource.OutRequest) *authn.Basic {
-	if req.Source.ContentTrust.Username != "" || req.Source.ContentTrust.Password != "" {
+func createNotaryAuth(source resource.Source) *authn.Basic {
+	if source.ContentTrust.Username != "" || source.ContentTrust.Password != "" {
 		return &authn.Basic{
-			Username: req.Source.ContentTrust.Username,
-			Password: req.Source.ContentTrust.Password,
+			Username: source.ContentTrust.Username,
+			Password: source.ContentTrust.Password,
 		}
 	}
 	// keep compatibility, fallback to using source.username & source.password
 	return &authn.Basic{
-		Username: req.Source.Username,
-		Password: req.Source.Password,
+		Username: source.Username,
+		Password: source.Password,
 	}
 }
 
 func aliasesToBump(req resource.OutRequest, repo name.Repository, ver *semver.Version) ([]name.Tag, error) {
 	variant := req.Source.Variant
 
-	repo, err := req.Source.NewRepository()
+	// existing tags may be read through a registry rewrite, but the aliases
+	// are always pushed to the repository itself
+	listSource, err := req.Source.Rewrite()
+	if err != nil {
+		return nil, fmt.Errorf("rewrite repository: %w", err)
+	}
+
+	listRepo, err := listSource.NewRepository()
 	if err != nil {
 		return nil, fmt.Errorf("resolve repository name: %w", err)
 	}
 
-	opts, err := req.Source.AuthOptions(repo, []string{transport.PullScope})
+	opts, err := listSource.AuthOptions(listRepo, []string{transport.PullScope})
 	if err != nil {
 		return nil, err
 	}
 
-	versions, err := remote.List(repo, opts...)
+	versions, err := remote.List(listRepo, opts...)
 	if err != nil && !isNewImage(err) {
 		return nil, fmt.Errorf("list repository tags: %w", err)
 	}
@@ -0,0 +1,194 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/simonshyu/notary-gcr/trust"
+	"github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/client"
+	"github.com/theupdateframework/notary/trustpinning"
+	"github.com/theupdateframework/notary/tuf/data"
+)
+
+var errTrustNotPinned = errors.New("content_trust needs root_key_ids or root_ca to pin the root of the trusted collection")
+
+// trustedDigest returns the digest signed for the tag in the notary server.
+// The trust data must chain up to the pinned root of the collection; it is
+// never trusted on first use.
+func trustedDigest(source resource.Source, tag name.Tag) (string, error) {
+	contentTrust := source.ContentTrust
+	if !contentTrust.Pinned() {
+		return "", errTrustNotPinned
+	}
+
+	registry := tag.Context().Registry
+	server, err := trust.Server(contentTrust.Server, &registry)
+	if err != nil {
+		return "", err
+	}
+
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("parse notary server: %w", err)
+	}
+
+	gun := tag.Context().String()
+	if serverURL.Host == trust.NotaryServerHostname {
+		gun = trust.NotaryServerIndexAlias + "/" + tag.Context().RepositoryStr()
+	}
+
+	// only trust data is kept here; no keys are needed to verify
+	cacheDir, err := os.MkdirTemp("", "notary-cache")
+	if err != nil {
+		return "", fmt.Errorf("create notary cache: %w", err)
+	}
+
+	defer os.RemoveAll(cacheDir)
+
+	trustPinning := trustpinning.TrustPinConfig{
+		DisableTOFU: true,
+	}
+
+	if len(contentTrust.RootKeyIDs) > 0 {
+		trustPinning.Certs = map[string][]string{gun: contentTrust.RootKeyIDs}
+	}
+
+	if contentTrust.RootCA != "" {
+		caPath := filepath.Join(cacheDir, "root-ca.crt")
+		err := os.WriteFile(caPath, []byte(contentTrust.RootCA), 0644)
+		if err != nil {
+			return "", fmt.Errorf("write root_ca: %w", err)
+		}
+
+		trustPinning.CA = map[string]string{gun: caPath}
+	}
+
+	rt, err := notaryTransport(source, serverURL, gun)
+	if err != nil {
+		return "", err
+	}
+
+	notaryRepo, err := client.NewFileCachedRepository(cacheDir, data.GUN(gun), server, rt, nil, trustPinning)
+	if err != nil {
+		return "", fmt.Errorf("open trusted collection %s: %w", gun, err)
+	}
+
+	target, err := notaryRepo.GetTargetByName(tag.Identifier(), trust.ReleasesRole, data.CanonicalTargetsRole)
+	if err != nil {
+		return "", fmt.Errorf("get trust data for %s: %w", tag.Identifier(), err)
+	}
+
+	// like docker, only trust tags signed by the targets role or the releases
+	// delegation
+	if target.Role != trust.ReleasesRole && target.Role != data.CanonicalTargetsRole {
+		return "", fmt.Errorf("no trust data for %s", tag.Identifier())
+	}
+
+	hash, found := target.Hashes["sha256"]
+	if !found {
+		return "", fmt.Errorf("trust data for %s has no sha256 hash", tag.Identifier())
+	}
+
+	return "sha256:" + hex.EncodeToString(hash), nil
+}
+
+// notaryTransport authenticates pulls of the collection's trust data,
+// verifying the notary server against the system roots and ca_certs.
+func notaryTransport(source resource.Source, serverURL *url.URL, gun string) (http.RoundTripper, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	for _, cert := range source.DomainCerts {
+		if ok := rootCAs.AppendCertsFromPEM([]byte(cert)); !ok {
+			return nil, fmt.Errorf("failed to append registry certificate")
+		}
+	}
+
+	config := &tls.Config{
+		RootCAs: rootCAs,
+	}
+
+	if source.ContentTrust.TLSCert != "" || source.ContentTrust.TLSKey != "" {
+		cert, err := tls.X509KeyPair([]byte(source.ContentTrust.TLSCert), []byte(source.ContentTrust.TLSKey))
+		if err != nil {
+			return nil, fmt.Errorf("load notary client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = config
+
+	reg, err := name.NewRegistry(serverURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("parse notary server: %w", err)
+	}
+
+	scopes := []string{fmt.Sprintf("repository:%s:%s", gun, transport.PullScope)}
+
+	rt, err := transport.NewWithContext(context.Background(), reg, createNotaryAuth(source), base, scopes)
+	if err != nil {
+		return nil, fmt.Errorf("initialize notary transport: %w", err)
+	}
+
+	return rt, nil
+}
+
+// verifyTrustedVersion returns an error unless the version's digest is the
+// one signed for its tag.
+func verifyTrustedVersion(source resource.Source, tag name.Tag, version resource.Version) error {
+	trusted, err := trustedDigest(source, tag)
+	if err != nil {
+		return err
+	}
+
+	if trusted != version.Digest {
+		return fmt.Errorf("%s is not signed for tag %s, which is signed for %s", version.Digest, tag.Identifier(), trusted)
+	}
+
+	return nil
+}
+
+// filterByTrust drops versions whose digest isn't the one signed for their
+// tag.
+func filterByTrust(source resource.Source, response resource.CheckResponse) (resource.CheckResponse, error) {
+	if !source.ContentTrust.Pinned() {
+		return nil, errTrustNotPinned
+	}
+
+	repo, err := source.NewRepository()
+	if err != nil {
+		return nil, fmt.Errorf("resolve repository: %w", err)
+	}
+
+	trusted := resource.CheckResponse{}
+	for _, version := range response {
+		err := verifyTrustedVersion(source, repo.Tag(version.Tag), version)
+		if err != nil {
+			logrus.Warnf("skipping %s: %s", version.Tag, err)
+			continue
+		}
+
+		trusted = append(trusted, version)
+	}
+
+	return trusted, nil
+}
@@ -2,25 +2,36 @@ package commands
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 
 	"github.com/concourse/go-archive/tarfs"
+	resource "github.com/concourse/registry-image-resource"
 	"github.com/fatih/color"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
 	"github.com/vbauerster/mpb"
 	"github.com/vbauerster/mpb/decor"
+	"golang.org/x/sync/errgroup"
 )
 
 const whiteoutPrefix = ".wh."
 const whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
 
-func unpackImage(dest string, img v1.Image, debug bool, out io.Writer) error {
+// number of layers to download at once, as with dockerd's default
+// max-concurrent-downloads
+const layerDownloadConcurrency = 3
+
+func unpackImage(dest string, img v1.Image, params resource.GetParams, cache *blobCache, debug bool, out io.Writer) error {
 	layers, err := img.Layers()
 	if err != nil {
 		return err
@@ -28,6 +39,13 @@ func unpackImage(dest string, img v1.Image, debug bool, out io.Writer) error {
 
 	chown := os.Getuid() == 0
 
+	xattrs := newXattrRestorer(params.Xattrs())
+
+	filter, err := newPathFilter(params.IncludePaths, params.ExcludePaths)
+	if err != nil {
+		return err
+	}
+
 	if debug {
 		out = io.Discard
 	}
@@ -35,34 +53,119 @@ func unpackImage(dest string, img v1.Image, debug bool, out io.Writer) error {
 	progress := mpb.New(mpb.WithOutput(out))
 
 	bars := make([]*mpb.Bar, len(layers))
+	diffIDs := make([]v1.Hash, len(layers))
 
 	for i, layer := range layers {
-		size, err := layer.Size()
+		diffIDs[i], err = layer.DiffID()
 		if err != nil {
 			return err
 		}
 
-		digest, err := layer.Digest()
+		bars[i], err = newLayerBar(progress, layer)
 		if err != nil {
 			return err
 		}
+	}
 
-		bars[i] = progress.AddBar(
-			size,
-			mpb.PrependDecorators(decor.Name(color.HiBlackString(digest.Hex[0:12]))),
-			mpb.AppendDecorators(decor.CountersKibiByte("%.1f/%.1f")),
-		)
+	// download next to the destination rather than in a possibly small /tmp
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dest), "layers-")
+	if err != nil {
+		return err
 	}
 
-	// iterate over layers in reverse order; no need to write things files that
-	// are modified by later layers anyway
-	for i, layer := range layers {
+	defer os.RemoveAll(tmpDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(layerDownloadConcurrency)
+
+	// download layers concurrently, in order so that the first layers are
+	// ready to extract first
+	files := make([]*os.File, len(layers))
+	downloaded := make([]chan struct{}, len(layers))
+	for i := range layers {
+		downloaded[i] = make(chan struct{})
+	}
+
+	launched := make(chan struct{})
+	go func() {
+		defer close(launched)
+
+		for i, layer := range layers {
+			g.Go(func() error {
+				defer close(downloaded[i])
+
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				f, err := downloadLayer(ctx, tmpDir, layer, cache, bars[i])
+				if err != nil {
+					return err
+				}
+
+				files[i] = f
+
+				return nil
+			})
+		}
+	}()
+
+	wait := func() error {
+		<-launched
+		err := g.Wait()
+
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+
+		return err
+	}
+
+	// layers must be extracted in order, as later layers modify earlier ones
+	for i := range layers {
+		select {
+		case <-downloaded[i]:
+		case <-ctx.Done():
+			// another download failed
+			return wait()
+		}
+
+		f := files[i]
+		if f == nil {
+			// the download failed
+			return wait()
+		}
+
 		logrus.Debugf("extracting layer %d of %d", i+1, len(layers))
 
-		err := extractLayer(dest, layer, bars[i], chown)
+		err := extractLayer(dest, f, diffIDs[i], chown, xattrs, filter)
 		if err != nil {
+			cancel()
+			wait()
 			return err
 		}
+
+		files[i] = nil
+		f.Close()
+
+		if cache == nil {
+			err = os.Remove(f.Name())
+			if err != nil {
+				cancel()
+				wait()
+				return err
+			}
+		}
+	}
+
+	err = wait()
+	if err != nil {
+		return err
 	}
 
 	progress.Wait()
@@ -70,18 +173,184 @@ func unpackImage(dest string, img v1.Image, debug bool, out io.Writer) error {
 	return nil
 }
 
-func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
+func newLayerBar(progress *mpb.Progress, layer v1.Layer) (*mpb.Bar, error) {
+	size, err := layer.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	return progress.AddBar(
+		size,
+		mpb.PrependDecorators(decor.Name(color.HiBlackString(digest.Hex[0:12]))),
+		mpb.AppendDecorators(decor.CountersKibiByte("%.1f/%.1f")),
+	), nil
+}
+
+// downloadLayer writes the compressed layer to a file in dir, or in the
+// cache if there is one, reporting progress to the bar. It returns the file
+// opened for reading, without downloading at all if the layer is cached. The
+// download is abandoned once ctx is done.
+func downloadLayer(ctx context.Context, dir string, layer v1.Layer, cache *blobCache, bar *mpb.Bar) (*os.File, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		f, found, err := cache.Open(digest)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			logrus.Debugf("using cached layer %s", digest)
+
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			bar.IncrBy(int(info.Size()))
+			bar.SetTotal(bar.Current(), true)
+
+			return f, nil
+		}
+	}
+
 	r, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	var f *os.File
+	if cache != nil {
+		f, err = cache.TempFile()
+	} else {
+		f, err = os.CreateTemp(dir, "layer-")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	downloaded := false
+	defer func() {
+		if !downloaded {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	_, err = io.Copy(f, bar.ProxyReader(contextReader{ctx: ctx, r: r}))
+	if err != nil {
+		return nil, err
+	}
+
+	// closing verifies the digest of the layer
+	err = r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	bar.SetTotal(bar.Current(), true)
+
+	if cache != nil {
+		err = f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		cached, err := cache.Store(digest, f.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		downloaded = true
+
+		return cached, nil
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	downloaded = true
+
+	return f, nil
+}
+
+// contextReader fails reads once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompress detects the compression of a layer from its magic bytes rather
+// than its media type, which registries and build tools don't always get
+// right. Layers without a known magic are assumed to be an uncompressed tar.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// extractLayer unpacks the layer into dest, verifying that the uncompressed
+// layer matches the diff ID from the image config.
+func extractLayer(dest string, r io.Reader, diffID v1.Hash, chown bool, xattrs *xattrRestorer, filter *pathFilter) error {
+	dr, err := decompress(r)
 	if err != nil {
 		return err
 	}
 
-	gr, err := gzip.NewReader(bar.ProxyReader(r))
+	defer dr.Close()
+
+	hasher, err := v1.Hasher(diffID.Algorithm)
 	if err != nil {
 		return err
 	}
 
-	tr := tar.NewReader(gr)
+	uncompressed := io.TeeReader(dr, hasher)
+
+	tr := tar.NewReader(uncompressed)
 
 	for {
 		hdr, err := tr.Next()
@@ -93,7 +362,31 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 			return err
 		}
 
-		path := filepath.Join(dest, filepath.Clean(hdr.Name))
+		name, err := confinedName(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		// whiteouts are applied whatever the filter, as they may remove
+		// what has been extracted from earlier layers
+		isWhiteout := strings.HasPrefix(filepath.Base(name), whiteoutPrefix)
+		if !isWhiteout && !filter.Selects(name, hdr.Typeflag == tar.TypeDir) {
+			continue
+		}
+
+		// symlinks in the parent directories are followed within dest, so
+		// that a layer can't write outside it through a symlink from an
+		// earlier entry
+		name, err = resolveParentInRoot(dest, name)
+		if err != nil {
+			return err
+		}
+
+		if name == "." && hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("%s: the rootfs can only be a directory", hdr.Name)
+		}
+
+		path := filepath.Join(dest, filepath.FromSlash(name))
 		base := filepath.Base(path)
 		dir := filepath.Dir(path)
 
@@ -104,38 +397,35 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 		log.Debug("unpacking")
 
 		if base == whiteoutOpaqueDir {
-			fi, err := os.Lstat(dir)
-			if err != nil && !os.IsNotExist(err) {
-				return err
-			}
-
 			log.Debugf("removing contents of %s", dir)
 
-			if err := os.RemoveAll(dir); err != nil {
-				return err
-
-			}
-			if err := os.Mkdir(dir, fi.Mode()&os.ModePerm); err != nil {
+			// only the directory's contents are hidden, not the directory
+			entries, err := os.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
 
-			if runtime.GOOS != "windows" && chown {
-				err = os.Lchown(dir, hdr.Uid, hdr.Gid)
-				if err != nil {
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
 					return err
 				}
 			}
+
 			continue
 		} else if strings.HasPrefix(base, whiteoutPrefix) {
 			// layer has marked a file as deleted
-			name := strings.TrimPrefix(base, whiteoutPrefix)
-			removedPath := filepath.Join(dir, name)
+			removed, err := whiteoutTarget(name)
+			if err != nil {
+				return err
+			}
+
+			removedPath := filepath.Join(dest, filepath.FromSlash(removed))
 
 			log.Debugf("removing %s", removedPath)
 
-			err := os.RemoveAll(removedPath)
+			err = os.RemoveAll(removedPath)
 			if err != nil {
-				return nil
+				return err
 			}
 
 			continue
@@ -151,12 +441,31 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 			log.Debugf("symlinking to %s", hdr.Linkname)
 		}
 
+		// extract a copy of the header with the names resolved within dest
+		entry := *hdr
+		entry.Name = name
+
 		if hdr.Typeflag == tar.TypeLink {
 			log.Debugf("hardlinking to %s", hdr.Linkname)
+
+			linkname, err := confinedName(hdr.Linkname)
+			if err != nil {
+				return fmt.Errorf("%s: hardlink to %s escapes the rootfs", hdr.Name, hdr.Linkname)
+			}
+
+			if !filter.Selects(linkname, false) {
+				logrus.Warnf("skipping %s, a hardlink to %s which is not extracted", hdr.Name, hdr.Linkname)
+				continue
+			}
+
+			entry.Linkname, err = resolveParentInRoot(dest, linkname)
+			if err != nil {
+				return err
+			}
 		}
 
 		if fi, err := os.Lstat(path); err == nil {
-			if fi.IsDir() && hdr.Name == "." {
+			if fi.IsDir() && name == "." {
 				continue
 			}
 
@@ -168,23 +477,30 @@ func extractLayer(dest string, layer v1.Layer, bar *mpb.Bar, chown bool) error {
 			}
 		}
 
-		if err := tarfs.ExtractEntry(hdr, dest, tr, chown); err != nil {
+		if err := tarfs.ExtractEntry(&entry, dest, tr, chown); err != nil {
 			log.Debugf("extracting")
 			return err
 		}
-	}
 
-	err = gr.Close()
-	if err != nil {
-		return err
+		// after extracting, as chowning a file clears its capabilities
+		if hdr.Typeflag != tar.TypeLink {
+			err := xattrs.Restore(path, hdr)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	err = r.Close()
+	// hash any padding after the end of the archive too
+	_, err = io.Copy(io.Discard, uncompressed)
 	if err != nil {
 		return err
 	}
 
-	bar.SetTotal(bar.Current(), true)
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != diffID.Hex {
+		return fmt.Errorf("layer diff ID mismatch: expected %s, got %s:%s", diffID, diffID.Algorithm, actual)
+	}
 
 	return nil
 }
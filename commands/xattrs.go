@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"archive/tar"
+	"fmt"
+	"slices"
+	"strings"
+
+	resource "github.com/concourse/registry-image-resource"
+	"github.com/sirupsen/logrus"
+)
+
+// prefix of the PAX records in which tar stores extended attributes
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// xattrRestorer sets the extended attributes of extracted files, such as
+// file capabilities and SELinux labels, according to the xattrs policy.
+type xattrRestorer struct {
+	policy string
+
+	// xattrs which couldn't be set, so that each is only warned about once
+	warned map[string]bool
+}
+
+func newXattrRestorer(policy string) *xattrRestorer {
+	return &xattrRestorer{
+		policy: policy,
+		warned: map[string]bool{},
+	}
+}
+
+func (x *xattrRestorer) Restore(path string, hdr *tar.Header) error {
+	if x.policy == resource.XattrsSkip {
+		return nil
+	}
+
+	var keys []string
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, xattrPAXPrefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, xattrPAXPrefix)
+
+		err := lsetxattr(path, name, []byte(hdr.PAXRecords[key]))
+		if err == nil {
+			continue
+		}
+
+		if x.policy == resource.XattrsFail {
+			return fmt.Errorf("set xattr %s on %s: %w", name, hdr.Name, err)
+		}
+
+		if !x.warned[name] {
+			logrus.Warnf("could not set xattr %s on %s (further failures to set it won't be reported): %s", name, hdr.Name, err)
+			x.warned[name] = true
+		}
+	}
+
+	return nil
+}
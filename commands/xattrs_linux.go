@@ -0,0 +1,7 @@
+package commands
+
+import "golang.org/x/sys/unix"
+
+func lsetxattr(path string, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
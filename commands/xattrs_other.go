@@ -0,0 +1,9 @@
+//go:build !linux
+
+package commands
+
+import "errors"
+
+func lsetxattr(path string, name string, value []byte) error {
+	return errors.New("xattrs are only supported on Linux")
+}
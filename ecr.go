@@ -0,0 +1,242 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+)
+
+// ECRImage is an image in an ECR repository, as described by the ECR API.
+type ECRImage struct {
+	Digest   string
+	Tags     []string
+	PushedAt time.Time
+}
+
+// UsesECRAPI reports whether tags should be listed through the ECR API
+// rather than the registry API.
+func (source Source) UsesECRAPI() bool {
+	return source.AwsEcrDescribeImages && source.ecrClient != nil
+}
+
+// DescribeECRImages lists the tagged images in the repository, following
+// pagination, with the client set up by AuthenticateToECR.
+func (source Source) DescribeECRImages() ([]ECRImage, error) {
+	if source.ecrClient == nil {
+		return nil, fmt.Errorf("not authenticated with ECR")
+	}
+
+	repo, err := name.NewRepository(source.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("parse repository: %w", err)
+	}
+
+	input := &ecr.DescribeImagesInput{
+		RepositoryName: aws.String(repo.RepositoryStr()),
+		Filter: &ecrtypes.DescribeImagesFilter{
+			TagStatus: ecrtypes.TagStatusTagged,
+		},
+	}
+
+	if source.AwsAccountId != "" {
+		input.RegistryId = aws.String(source.AwsAccountId)
+	}
+
+	var images []ECRImage
+
+	paginator := ecr.NewDescribeImagesPaginator(source.ecrClient, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("describe images: %w", err)
+		}
+
+		for _, detail := range page.ImageDetails {
+			image := ECRImage{
+				Digest: aws.ToString(detail.ImageDigest),
+				Tags:   detail.ImageTags,
+			}
+
+			if detail.ImagePushedAt != nil {
+				image.PushedAt = *detail.ImagePushedAt
+			}
+
+			images = append(images, image)
+		}
+	}
+
+	return images, nil
+}
+
+// ScanGate withholds versions from check until their ECR image scan has
+// completed without exceeding the allowed number of findings.
+type ScanGate struct {
+	// Maximum number of findings allowed per severity, e.g. CRITICAL: 0.
+	// Severities which are not listed are not limited.
+	MaxFindings map[string]int `json:"max_findings,omitempty"`
+}
+
+// Exceeded returns the severities for which the counts exceed the allowed
+// number of findings.
+func (gate ScanGate) Exceeded(counts map[string]int) []string {
+	var exceeded []string
+	for severity, max := range gate.MaxFindings {
+		if counts[strings.ToUpper(severity)] > max {
+			exceeded = append(exceeded, strings.ToUpper(severity))
+		}
+	}
+
+	sort.Strings(exceeded)
+
+	return exceeded
+}
+
+// ECRScanFindings returns whether the scan of the image has completed, and
+// if so the number of findings per severity.
+func (source Source) ECRScanFindings(digest string) (bool, map[string]int, error) {
+	if source.ecrClient == nil {
+		return false, nil, fmt.Errorf("not authenticated with ECR")
+	}
+
+	repo, err := name.NewRepository(source.Repository)
+	if err != nil {
+		return false, nil, fmt.Errorf("parse repository: %w", err)
+	}
+
+	input := &ecr.DescribeImageScanFindingsInput{
+		RepositoryName: aws.String(repo.RepositoryStr()),
+		ImageId: &ecrtypes.ImageIdentifier{
+			ImageDigest: aws.String(digest),
+		},
+	}
+
+	if source.AwsAccountId != "" {
+		input.RegistryId = aws.String(source.AwsAccountId)
+	}
+
+	output, err := source.ecrClient.DescribeImageScanFindings(context.TODO(), input)
+	if err != nil {
+		var notFound *ecrtypes.ScanNotFoundException
+		if errors.As(err, &notFound) {
+			return false, nil, nil
+		}
+
+		return false, nil, fmt.Errorf("describe image scan findings: %w", err)
+	}
+
+	if output.ImageScanStatus == nil {
+		return false, nil, nil
+	}
+
+	switch output.ImageScanStatus.Status {
+	case ecrtypes.ScanStatusComplete, ecrtypes.ScanStatusActive:
+	default:
+		return false, nil, nil
+	}
+
+	counts := map[string]int{}
+	if output.ImageScanFindings != nil {
+		for severity, count := range output.ImageScanFindings.FindingSeverityCounts {
+			counts[severity] = int(count)
+		}
+	}
+
+	return true, counts, nil
+}
+
+// ECRRepositorySettings configures an ECR repository created by put.
+type ECRRepositorySettings struct {
+	// Prevent tags from being overwritten once pushed.
+	ImmutableTags bool `json:"immutable_tags,omitempty"`
+
+	// Scan images for vulnerabilities when they are pushed.
+	ScanOnPush bool `json:"scan_on_push,omitempty"`
+
+	// Either AES256 (the default) or KMS.
+	EncryptionType string `json:"encryption_type,omitempty"`
+
+	// The KMS key to encrypt with, if EncryptionType is KMS. Defaults to the
+	// AWS managed key for ECR.
+	KmsKey string `json:"kms_key,omitempty"`
+
+	// Path to a file containing a lifecycle policy for the repository.
+	LifecyclePolicy string `json:"lifecycle_policy,omitempty"`
+}
+
+// CreateECRRepository creates the repository with the given settings, and
+// applies the lifecycle policy if one is given. Nothing is changed if the
+// repository already exists, so that settings managed elsewhere are left
+// alone.
+func (source Source) CreateECRRepository(settings ECRRepositorySettings, lifecyclePolicy string) error {
+	if source.ecrClient == nil {
+		return fmt.Errorf("not authenticated with ECR")
+	}
+
+	repo, err := name.NewRepository(source.Repository)
+	if err != nil {
+		return fmt.Errorf("parse repository: %w", err)
+	}
+
+	input := &ecr.CreateRepositoryInput{
+		RepositoryName:     aws.String(repo.RepositoryStr()),
+		ImageTagMutability: ecrtypes.ImageTagMutabilityMutable,
+		ImageScanningConfiguration: &ecrtypes.ImageScanningConfiguration{
+			ScanOnPush: settings.ScanOnPush,
+		},
+	}
+
+	if settings.ImmutableTags {
+		input.ImageTagMutability = ecrtypes.ImageTagMutabilityImmutable
+	}
+
+	if settings.EncryptionType != "" {
+		input.EncryptionConfiguration = &ecrtypes.EncryptionConfiguration{
+			EncryptionType: ecrtypes.EncryptionType(settings.EncryptionType),
+		}
+
+		if settings.KmsKey != "" {
+			input.EncryptionConfiguration.KmsKey = aws.String(settings.KmsKey)
+		}
+	}
+
+	if source.AwsAccountId != "" {
+		input.RegistryId = aws.String(source.AwsAccountId)
+	}
+
+	_, err = source.ecrClient.CreateRepository(context.TODO(), input)
+	if err != nil {
+		var exists *ecrtypes.RepositoryAlreadyExistsException
+		if errors.As(err, &exists) {
+			logrus.Debugf("repository %s already exists", repo.RepositoryStr())
+			return nil
+		}
+
+		return fmt.Errorf("create repository: %w", err)
+	}
+
+	logrus.Infof("created repository %s", repo.RepositoryStr())
+
+	if lifecyclePolicy == "" {
+		return nil
+	}
+
+	_, err = source.ecrClient.PutLifecyclePolicy(context.TODO(), &ecr.PutLifecyclePolicyInput{
+		RepositoryName:      aws.String(repo.RepositoryStr()),
+		LifecyclePolicyText: aws.String(lifecyclePolicy),
+		RegistryId:          input.RegistryId,
+	})
+	if err != nil {
+		return fmt.Errorf("put lifecycle policy: %w", err)
+	}
+
+	return nil
+}
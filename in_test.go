@@ -2,11 +2,14 @@ package resource_test
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,13 +17,19 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/compression"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/sys/unix"
 
 	resource "github.com/concourse/registry-image-resource"
 	"github.com/concourse/registry-image-resource/commands"
@@ -895,3 +904,1417 @@ var _ = Describe("In", func() {
 		})
 	})
 })
+
+var _ = Describe("fetching a version from one of multiple repositories", func() {
+	var registryServer *httptest.Server
+	var destDir string
+	var req resource.InRequest
+
+	var current, legacy string
+
+	BeforeEach(func() {
+		var err error
+		destDir, err = os.MkdirTemp("", "docker-image-in-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		registryServer = newTestRegistry()
+
+		current = registryServer.Listener.Addr().String() + "/org/app"
+		legacy = registryServer.Listener.Addr().String() + "/org/app-server"
+
+		image := pushRandomImage(legacy + ":1.0.0")
+
+		req = resource.InRequest{
+			Source: resource.Source{
+				Repository:   current,
+				Repositories: []string{legacy},
+			},
+			Version: resource.Version{
+				Tag:        "1.0.0",
+				Digest:     imageDigest(image),
+				Repository: legacy,
+			},
+		}
+	})
+
+	AfterEach(func() {
+		registryServer.Close()
+		Expect(os.RemoveAll(destDir)).To(Succeed())
+	})
+
+	It("fetches the image from the version's repository", func() {
+		Expect(runIn(destDir, req)).To(Succeed())
+
+		Expect(cat(filepath.Join(destDir, "repository"))).To(Equal(legacy))
+	})
+
+	It("refuses to fetch from a repository that is not configured", func() {
+		req.Source.Repositories = nil
+
+		Expect(runIn(destDir, req)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("fetching through multiple registry mirrors", func() {
+	var origin, firstMirror, secondMirror *httptest.Server
+	var destDir string
+	var req resource.InRequest
+
+	BeforeEach(func() {
+		var err error
+		destDir, err = os.MkdirTemp("", "docker-image-in-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		origin = newTestRegistry()
+		firstMirror = newTestRegistry()
+		secondMirror = newTestRegistry()
+
+		// only the second mirror has the image; the origin is empty
+		image := pushRandomImage(secondMirror.Listener.Addr().String() + "/org/app:1.0.0")
+
+		req = resource.InRequest{
+			Source: resource.Source{
+				Repository: origin.Listener.Addr().String() + "/org/app",
+				RegistryMirrors: []resource.RegistryMirror{
+					{
+						Host:       firstMirror.Listener.Addr().String(),
+						Registries: []string{"127.0.0.1:*"},
+					},
+					{
+						Host:       secondMirror.Listener.Addr().String(),
+						Registries: []string{"127.0.0.1:*"},
+					},
+				},
+			},
+			Version: resource.Version{
+				Tag:    "1.0.0",
+				Digest: imageDigest(image),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		origin.Close()
+		firstMirror.Close()
+		secondMirror.Close()
+		Expect(os.RemoveAll(destDir)).To(Succeed())
+	})
+
+	It("tries each mirror in order", func() {
+		Expect(runIn(destDir, req)).To(Succeed())
+
+		_, err := os.Stat(filepath.Join(destDir, "rootfs"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Context("when a failing mirror is fatal", func() {
+		BeforeEach(func() {
+			req.Source.RegistryMirrors[0].Fatal = true
+		})
+
+		It("exits non-zero rather than trying the next mirror", func() {
+			Expect(runIn(destDir, req)).ToNot(Succeed())
+		})
+	})
+})
+
+var _ = Describe("fetching through a registry rewrite", func() {
+	var proxy *httptest.Server
+	var destDir string
+	var req resource.InRequest
+
+	BeforeEach(func() {
+		var err error
+		destDir, err = os.MkdirTemp("", "docker-image-in-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		proxy = newTestRegistry()
+
+		image := pushRandomImage(proxy.Listener.Addr().String() + "/ghcr-proxy/org/app:1.0.0")
+
+		req = resource.InRequest{
+			Source: resource.Source{
+				Repository: "ghcr.io/org/app",
+				RegistryRewrites: []resource.RegistryRewrite{
+					{
+						Prefix:   "ghcr.io/",
+						Location: proxy.Listener.Addr().String() + "/ghcr-proxy/",
+					},
+				},
+			},
+			Version: resource.Version{
+				Tag:    "1.0.0",
+				Digest: imageDigest(image),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		proxy.Close()
+		Expect(os.RemoveAll(destDir)).To(Succeed())
+	})
+
+	It("fetches the image from the rewritten location", func() {
+		Expect(runIn(destDir, req)).To(Succeed())
+
+		_, err := os.Stat(filepath.Join(destDir, "rootfs"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(cat(filepath.Join(destDir, "repository"))).To(Equal("ghcr.io/org/app"))
+	})
+})
+
+var _ = Describe("populating a mirror on pull-through", func() {
+	var origin, mirror *httptest.Server
+	var destDir string
+	var req resource.InRequest
+
+	var image v1.Image
+
+	BeforeEach(func() {
+		var err error
+		destDir, err = os.MkdirTemp("", "docker-image-in-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		origin = newTestRegistry()
+		mirror = newTestRegistry()
+
+		image = pushRandomImage(origin.Listener.Addr().String() + "/org/app:1.0.0")
+
+		req = resource.InRequest{
+			Source: resource.Source{
+				Repository: origin.Listener.Addr().String() + "/org/app",
+				RegistryMirror: &resource.RegistryMirror{
+					Host:       mirror.Listener.Addr().String(),
+					Registries: []string{"127.0.0.1:*"},
+					Populate:   true,
+				},
+			},
+			Version: resource.Version{
+				Tag:    "1.0.0",
+				Digest: imageDigest(image),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		origin.Close()
+		mirror.Close()
+		Expect(os.RemoveAll(destDir)).To(Succeed())
+	})
+
+	It("copies the image fetched from the origin into the mirror", func() {
+		Expect(runIn(destDir, req)).To(Succeed())
+
+		Expect(latestDigest(mirror.Listener.Addr().String() + "/org/app:1.0.0")).To(Equal(imageDigest(image)))
+	})
+
+	Context("when fetching an older digest of the tag", func() {
+		var newer v1.Image
+
+		BeforeEach(func() {
+			// the tag has moved on, and the mirror is missing the older digest
+			newer = pushRandomImage(origin.Listener.Addr().String() + "/org/app:1.0.0")
+			pushImage(mirror.Listener.Addr().String()+"/org/app:1.0.0", newer)
+		})
+
+		It("copies the image by digest without moving the mirror's tag", func() {
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			Expect(latestDigest(mirror.Listener.Addr().String() + "/org/app:1.0.0")).To(Equal(imageDigest(newer)))
+			Expect(latestDigest(mirror.Listener.Addr().String() + "/org/app@" + imageDigest(image))).To(Equal(imageDigest(image)))
+		})
+	})
+})
+
+var _ = Describe("fetching from a mirror which serves the wrong digest", func() {
+	var origin *httptest.Server
+	var mirror *ghttp.Server
+	var destDir string
+	var req resource.InRequest
+
+	BeforeEach(func() {
+		var err error
+		destDir, err = os.MkdirTemp("", "docker-image-in-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		origin = newTestRegistry()
+		mirror = ghttp.NewServer()
+
+		image := pushRandomImage(origin.Listener.Addr().String() + "/org/app:1.0.0")
+
+		mirror.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, ""))
+		mirror.RouteToHandler("HEAD", "/v2/org/app/manifests/"+imageDigest(image), ghttp.RespondWith(http.StatusOK, "", http.Header{
+			"Docker-Content-Digest": {OLDER_FAKE_DIGEST},
+		}))
+
+		req = resource.InRequest{
+			Source: resource.Source{
+				Repository: origin.Listener.Addr().String() + "/org/app",
+				RegistryMirror: &resource.RegistryMirror{
+					Host:       mirror.Addr(),
+					Registries: []string{"127.0.0.1:*"},
+				},
+			},
+			Version: resource.Version{
+				Tag:    "1.0.0",
+				Digest: imageDigest(image),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		origin.Close()
+		mirror.Close()
+		Expect(os.RemoveAll(destDir)).To(Succeed())
+	})
+
+	It("refuses the mirror and falls back to the origin with the warn policy", func() {
+		req.Source.RegistryMirror.Verify = resource.MirrorVerifyWarn
+
+		Expect(runIn(destDir, req)).To(Succeed())
+
+		_, err := os.Stat(filepath.Join(destDir, "rootfs"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("fails with the fail policy", func() {
+		req.Source.RegistryMirror.Verify = resource.MirrorVerifyFail
+
+		Expect(runIn(destDir, req)).ToNot(Succeed())
+	})
+
+	Context("when the mirror cannot be verified", func() {
+		BeforeEach(func() {
+			mirror.RouteToHandler("HEAD", "/v2/org/app/manifests/"+req.Version.Digest, ghttp.RespondWith(http.StatusInternalServerError, ""))
+		})
+
+		It("falls back to the origin with the warn policy", func() {
+			req.Source.RegistryMirror.Verify = resource.MirrorVerifyWarn
+
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			_, err := os.Stat(filepath.Join(destDir, "rootfs"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("fails with the fail policy", func() {
+			req.Source.RegistryMirror.Verify = resource.MirrorVerifyFail
+
+			Expect(runIn(destDir, req)).To(MatchError(ContainSubstring("cannot verify mirror")))
+		})
+	})
+})
+
+var _ = Describe("fetching with content trust verification", func() {
+	var registryServer *httptest.Server
+	var notary *fakeNotary
+	var destDir string
+	var image v1.Image
+	var req resource.InRequest
+
+	serveTrustData := func(signed map[string]string) {
+		notary = newFakeNotary(registryServer.Listener.Addr().String()+"/org/app", signed)
+
+		req.Source.DomainCerts = []string{notary.CACert()}
+		req.Source.ContentTrust.Server = notary.URL
+		req.Source.ContentTrust.RootKeyIDs = []string{notary.RootKeyID}
+	}
+
+	BeforeEach(func() {
+		var err error
+		destDir, err = os.MkdirTemp("", "docker-image-in-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		registryServer = newTestRegistry()
+
+		image = pushRandomImage(registryServer.Listener.Addr().String() + "/org/app:1.0.0")
+
+		req = resource.InRequest{
+			Source: resource.Source{
+				Repository: registryServer.Listener.Addr().String() + "/org/app",
+				ContentTrust: &resource.ContentTrust{
+					Verify: true,
+				},
+			},
+			Version: resource.Version{
+				Tag:    "1.0.0",
+				Digest: imageDigest(image),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		if notary != nil {
+			notary.Close()
+			notary = nil
+		}
+
+		registryServer.Close()
+		Expect(os.RemoveAll(destDir)).To(Succeed())
+	})
+
+	It("fetches a version whose digest is signed for its tag", func() {
+		serveTrustData(map[string]string{"1.0.0": imageDigest(image)})
+
+		err := runIn(destDir, req)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = os.Stat(filepath.Join(destDir, "rootfs"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("fetches a version when the root is pinned by its CA", func() {
+		serveTrustData(map[string]string{"1.0.0": imageDigest(image)})
+
+		req.Source.ContentTrust.RootKeyIDs = nil
+		req.Source.ContentTrust.RootCA = notary.RootCA
+
+		err := runIn(destDir, req)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("refuses to fetch a version when a different digest is signed for its tag", func() {
+		other := pushRandomImage(registryServer.Listener.Addr().String() + "/org/app:other")
+		serveTrustData(map[string]string{"1.0.0": imageDigest(other)})
+
+		err := runIn(destDir, req)
+		Expect(err).To(MatchError(ContainSubstring("content trust verification failed")))
+		Expect(err).To(MatchError(ContainSubstring("is not signed for tag 1.0.0, which is signed for " + imageDigest(other))))
+
+		_, err = os.Stat(filepath.Join(destDir, "rootfs"))
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+
+	It("refuses to fetch a version which is not signed", func() {
+		serveTrustData(map[string]string{"2.0.0": imageDigest(image)})
+
+		err := runIn(destDir, req)
+		Expect(err).To(MatchError(ContainSubstring("content trust verification failed")))
+
+		_, err = os.Stat(filepath.Join(destDir, "rootfs"))
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+
+	It("refuses trust data whose root is not the pinned one", func() {
+		serveTrustData(map[string]string{"1.0.0": imageDigest(image)})
+
+		req.Source.ContentTrust.RootKeyIDs = []string{strings.Repeat("0", 64)}
+
+		err := runIn(destDir, req)
+		Expect(err).To(MatchError(ContainSubstring("could not validate the path to a trusted root")))
+
+		_, err = os.Stat(filepath.Join(destDir, "rootfs"))
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+
+	It("requires the root to be pinned", func() {
+		serveTrustData(map[string]string{"1.0.0": imageDigest(image)})
+
+		req.Source.ContentTrust.RootKeyIDs = nil
+
+		err := runIn(destDir, req)
+		Expect(err).To(MatchError(ContainSubstring("content_trust needs root_key_ids or root_ca")))
+	})
+})
+
+var _ = Describe("unpacking a rootfs", func() {
+	var registryServer *httptest.Server
+	var destDir string
+	var repo string
+
+	push := func(image v1.Image) resource.InRequest {
+		pushImage(repo+":latest", image)
+
+		return resource.InRequest{
+			Source: resource.Source{
+				Repository: repo,
+			},
+			Version: resource.Version{
+				Tag:    "latest",
+				Digest: imageDigest(image),
+			},
+		}
+	}
+
+	rootfs := func(path string) string {
+		return filepath.Join(destDir, "rootfs", path)
+	}
+
+	BeforeEach(func() {
+		var err error
+		destDir, err = os.MkdirTemp("", "docker-image-in-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		registryServer = newTestRegistry()
+		repo = registryServer.Listener.Addr().String() + "/test-image"
+	})
+
+	AfterEach(func() {
+		registryServer.Close()
+		Expect(os.RemoveAll(destDir)).To(Succeed())
+	})
+
+	It("applies layers in order, however many are downloaded at once", func() {
+		var layers []v1.Layer
+		for i := 1; i <= 8; i++ {
+			layers = append(layers, tarLayer(
+				layerFile(fmt.Sprintf("layer-%d", i), "present"),
+				layerFile("shared", fmt.Sprintf("from layer %d", i)),
+			))
+		}
+
+		Expect(runIn(destDir, push(imageWithLayers(layers...)))).To(Succeed())
+
+		for i := 1; i <= 8; i++ {
+			Expect(cat(rootfs(fmt.Sprintf("layer-%d", i)))).To(Equal("present"))
+		}
+
+		Expect(cat(rootfs("shared"))).To(Equal("from layer 8"))
+
+		// temporary downloads are cleaned up
+		entries, err := os.ReadDir(destDir)
+		Expect(err).ToNot(HaveOccurred())
+		for _, entry := range entries {
+			Expect(entry.Name()).ToNot(HavePrefix("layers-"))
+		}
+	})
+
+	It("unpacks zstd and uncompressed layers", func() {
+		image := imageWithLayers(
+			tarLayer(layerFile("gzip", "gzip"), layerFile("shared", "gzip")),
+			compressedTarLayer(compression.ZStd, layerFile("zstd", "zstd"), layerFile("shared", "zstd")),
+			static.NewLayer(tarContents(layerFile("none", "none"), layerFile("shared", "none")), types.OCIUncompressedLayer),
+		)
+
+		Expect(runIn(destDir, push(image))).To(Succeed())
+
+		Expect(cat(rootfs("gzip"))).To(Equal("gzip"))
+		Expect(cat(rootfs("zstd"))).To(Equal("zstd"))
+		Expect(cat(rootfs("none"))).To(Equal("none"))
+		Expect(cat(rootfs("shared"))).To(Equal("none"))
+	})
+
+	It("fails if a layer doesn't match its diff ID", func() {
+		image := imageWithLayers(
+			tarLayer(layerFile("first", "first")),
+			tarLayer(layerFile("second", "second")),
+		)
+
+		// upload the layers
+		pushImage(repo+":original", image)
+
+		config, err := image.ConfigFile()
+		Expect(err).ToNot(HaveOccurred())
+
+		// as if the config and layer were mismatched by a broken mirror
+		config = config.DeepCopy()
+		config.RootFS.DiffIDs[1], _, err = v1.SHA256(strings.NewReader("something else"))
+		Expect(err).ToNot(HaveOccurred())
+
+		rawConfig, err := json.Marshal(config)
+		Expect(err).ToNot(HaveOccurred())
+
+		configLayer := static.NewLayer(rawConfig, types.DockerConfigJSON)
+
+		repository, err := name.NewRepository(repo)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.WriteLayer(repository, configLayer)).To(Succeed())
+
+		manifest, err := image.Manifest()
+		Expect(err).ToNot(HaveOccurred())
+
+		manifest = manifest.DeepCopy()
+		manifest.Config.Digest, err = configLayer.Digest()
+		Expect(err).ToNot(HaveOccurred())
+		manifest.Config.Size = int64(len(rawConfig))
+
+		rawManifest, err := json.Marshal(manifest)
+		Expect(err).ToNot(HaveOccurred())
+
+		tag, err := name.NewTag(repo + ":latest")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.Put(tag, rawTaggable{rawManifest, manifest.MediaType})).To(Succeed())
+
+		digest, _, err := v1.SHA256(bytes.NewReader(rawManifest))
+		Expect(err).ToNot(HaveOccurred())
+
+		err = runIn(destDir, resource.InRequest{
+			Source:  resource.Source{Repository: repo},
+			Version: resource.Version{Tag: "latest", Digest: digest.String()},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("layer diff ID mismatch"))
+	})
+
+	It("writes the image's runtime config to metadata.json and env", func() {
+		image, err := mutate.Config(imageWithLayers(tarLayer(layerFile("some-file", "present"))), v1.Config{
+			Env:          []string{"PATH=/usr/bin:/bin", "QUOTED=it's $HOME", "EMPTY="},
+			User:         "someuser",
+			WorkingDir:   "/app",
+			Entrypoint:   []string{"/app/run"},
+			Cmd:          []string{"--serve"},
+			ExposedPorts: map[string]struct{}{"8080/tcp": {}, "53/udp": {}},
+			Volumes:      map[string]struct{}{"/data": {}},
+			StopSignal:   "SIGQUIT",
+			Healthcheck: &v1.HealthConfig{
+				Test:     []string{"CMD", "/app/healthy"},
+				Interval: 30 * time.Second,
+				Retries:  3,
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(runIn(destDir, push(image))).To(Succeed())
+
+		Expect(cat(filepath.Join(destDir, "metadata.json"))).To(MatchJSON(`{
+			"env": ["PATH=/usr/bin:/bin", "QUOTED=it's $HOME", "EMPTY="],
+			"user": "someuser",
+			"working_dir": "/app",
+			"entrypoint": ["/app/run"],
+			"cmd": ["--serve"],
+			"exposed_ports": ["53/udp", "8080/tcp"],
+			"volumes": ["/data"],
+			"stop_signal": "SIGQUIT",
+			"healthcheck": {
+				"test": ["CMD", "/app/healthy"],
+				"interval": "30s",
+				"retries": 3
+			}
+		}`))
+
+		script := fmt.Sprintf(`. %s && printf '%%s\n' "$PATH" "$QUOTED" "[$EMPTY]"`, filepath.Join(destDir, "env"))
+		out, err := exec.Command("sh", "-c", script).Output()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(out)).To(Equal("/usr/bin:/bin\nit's $HOME\n[]\n"))
+	})
+
+	It("leaves out runtime config the image doesn't have", func() {
+		Expect(runIn(destDir, push(imageWithLayers(tarLayer(layerFile("some-file", "present")))))).To(Succeed())
+
+		Expect(cat(filepath.Join(destDir, "metadata.json"))).To(MatchJSON(`{"env": null, "user": ""}`))
+		Expect(cat(filepath.Join(destDir, "env"))).To(BeEmpty())
+	})
+
+	It("applies whiteouts from later layers", func() {
+		image := imageWithLayers(
+			tarLayer(
+				layerFile("removed", "removed"),
+				layerFile("kept", "kept"),
+				layerFile("opaque/hidden", "hidden"),
+			),
+			tarLayer(
+				layerFile(".wh.removed", ""),
+				layerFile("opaque/.wh..wh..opq", ""),
+				layerFile("opaque/added", "added"),
+				layerFile("missing/.wh..wh..opq", ""),
+			),
+		)
+
+		Expect(runIn(destDir, push(image))).To(Succeed())
+
+		Expect(rootfs("removed")).ToNot(BeAnExistingFile())
+		Expect(cat(rootfs("kept"))).To(Equal("kept"))
+		Expect(rootfs("opaque/hidden")).ToNot(BeAnExistingFile())
+		Expect(cat(rootfs("opaque/added"))).To(Equal("added"))
+		Expect(rootfs(".wh.removed")).ToNot(BeAnExistingFile())
+	})
+
+	Context("with path filters", func() {
+		var image v1.Image
+
+		BeforeEach(func() {
+			image = imageWithLayers(
+				tarLayer(
+					layerFile("bin/sh", "sh"),
+					layerFile("bin/java-real", "java"),
+					layerFile("etc/passwd", "passwd"),
+					layerFile("usr/lib/jvm/release", "release"),
+					layerFile("usr/lib/jvm/removed", "removed"),
+					layerFile("usr/lib/jvm/docs/README", "readme"),
+					layerFile("usr/lib/other/lib.so", "other"),
+				),
+				tarLayer(
+					layerFile("usr/lib/jvm/.wh.removed", ""),
+					layerFile("usr/lib/jvm/added", "added"),
+					layerHardlink("bin/java", "bin/java-real"),
+					layerHardlink("usr/lib/jvm/java", "bin/java-real"),
+				),
+			)
+		})
+
+		It("only extracts included paths", func() {
+			req := push(image)
+			req.Params.IncludePaths = []string{"/usr/lib/jvm", "bin/java*"}
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			Expect(cat(rootfs("usr/lib/jvm/release"))).To(Equal("release"))
+			Expect(cat(rootfs("usr/lib/jvm/added"))).To(Equal("added"))
+			Expect(cat(rootfs("usr/lib/jvm/docs/README"))).To(Equal("readme"))
+			Expect(cat(rootfs("bin/java"))).To(Equal("java"))
+			Expect(cat(rootfs("usr/lib/jvm/java"))).To(Equal("java"))
+
+			Expect(rootfs("usr/lib/jvm/removed")).ToNot(BeAnExistingFile())
+			Expect(rootfs("usr/lib/other")).ToNot(BeAnExistingFile())
+			Expect(rootfs("bin/sh")).ToNot(BeAnExistingFile())
+			Expect(rootfs("etc")).ToNot(BeAnExistingFile())
+		})
+
+		It("doesn't extract excluded paths", func() {
+			req := push(image)
+			req.Params.ExcludePaths = []string{"usr/lib/jvm/docs", "usr/lib/*/*.so"}
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			Expect(cat(rootfs("usr/lib/jvm/release"))).To(Equal("release"))
+			Expect(cat(rootfs("etc/passwd"))).To(Equal("passwd"))
+			Expect(cat(rootfs("bin/sh"))).To(Equal("sh"))
+
+			Expect(rootfs("usr/lib/jvm/docs")).ToNot(BeAnExistingFile())
+			Expect(rootfs("usr/lib/other/lib.so")).ToNot(BeAnExistingFile())
+			Expect(rootfs("usr/lib/jvm/removed")).ToNot(BeAnExistingFile())
+		})
+
+		It("skips hardlinks to paths which aren't extracted", func() {
+			req := push(image)
+			req.Params.IncludePaths = []string{"usr/lib/jvm"}
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			Expect(cat(rootfs("usr/lib/jvm/release"))).To(Equal("release"))
+			Expect(rootfs("usr/lib/jvm/java")).ToNot(BeAnExistingFile())
+			Expect(rootfs("bin")).ToNot(BeAnExistingFile())
+		})
+
+		It("applies whiteouts of directories containing included paths", func() {
+			req := push(imageWithLayers(
+				tarLayer(
+					layerFile("usr/lib/jvm/old", "old"),
+					layerFile("opt/app/old", "old"),
+				),
+				tarLayer(
+					layerFile("usr/.wh.lib", ""),
+					layerFile("opt/app/.wh..wh..opq", ""),
+				),
+				tarLayer(
+					layerFile("usr/lib/jvm/new", "new"),
+					layerFile("opt/app/new", "new"),
+				),
+			))
+			req.Params.IncludePaths = []string{"usr/lib/jvm", "opt/app"}
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			Expect(rootfs("usr/lib/jvm/old")).ToNot(BeAnExistingFile())
+			Expect(rootfs("opt/app/old")).ToNot(BeAnExistingFile())
+			Expect(cat(rootfs("usr/lib/jvm/new"))).To(Equal("new"))
+			Expect(cat(rootfs("opt/app/new"))).To(Equal("new"))
+		})
+
+		It("rejects invalid patterns", func() {
+			req := push(image)
+			req.Params.IncludePaths = []string{"usr/lib/["}
+
+			err := runIn(destDir, req)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`invalid path pattern "usr/lib/["`))
+		})
+	})
+
+	Context("in the files format", func() {
+		var image v1.Image
+
+		BeforeEach(func() {
+			tool := layerFile("opt/app/bin/tool", "tool v1")
+			tool.Mode = 0755
+
+			image = imageWithLayers(
+				tarLayer(
+					tool,
+					layerFile("opt/app/share/removed", "removed"),
+					layerFile("opt/app/share/hidden/file", "hidden"),
+					layerFile("etc/config", "config v1"),
+				),
+				tarLayer(
+					layerFile("opt/app/share/.wh.removed", ""),
+					layerFile("opt/app/share/hidden/.wh..wh..opq", ""),
+					layerFile("opt/app/share/hidden/visible", "visible"),
+					layerFile("etc/config", "config v2"),
+					layerHardlink("etc/config-link", "etc/config"),
+					layerSymlink("app", "/opt/app"),
+					layerSymlink("usr/bin/tool", "../../app/bin/tool"),
+					layerSymlink("opt/app/share/tool", "../bin/tool"),
+				),
+			)
+		})
+
+		extract := func(paths ...resource.ExtractPath) error {
+			req := push(image)
+			req.Params.RawFormat = "files"
+			req.Params.Extract = paths
+			return runIn(destDir, req)
+		}
+
+		output := func(path string) string {
+			return filepath.Join(destDir, path)
+		}
+
+		It("writes the final version of each file", func() {
+			Expect(extract(
+				resource.ExtractPath{Src: "/etc/config", Dest: "config/app.conf"},
+				resource.ExtractPath{Src: "/etc/config-link"},
+			)).To(Succeed())
+
+			Expect(cat(output("config/app.conf"))).To(Equal("config v2"))
+			Expect(cat(output("config-link"))).To(Equal("config v2"))
+
+			Expect(output("rootfs")).ToNot(BeAnExistingFile())
+			Expect(output("metadata.json")).ToNot(BeAnExistingFile())
+
+			entries, err := os.ReadDir(destDir)
+			Expect(err).ToNot(HaveOccurred())
+			for _, entry := range entries {
+				Expect(entry.Name()).ToNot(HavePrefix("layers-"))
+			}
+		})
+
+		It("follows symlinks to the file", func() {
+			Expect(extract(resource.ExtractPath{Src: "/usr/bin/tool", Dest: "bin/tool"})).To(Succeed())
+
+			Expect(cat(output("bin/tool"))).To(Equal("tool v1"))
+
+			info, err := os.Lstat(output("bin/tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode()).To(Equal(os.FileMode(0755)))
+		})
+
+		It("copies directories, respecting whiteouts", func() {
+			Expect(extract(resource.ExtractPath{Src: "/app/share"})).To(Succeed())
+
+			Expect(output("share/removed")).ToNot(BeAnExistingFile())
+			Expect(output("share/hidden/file")).ToNot(BeAnExistingFile())
+			Expect(cat(output("share/hidden/visible"))).To(Equal("visible"))
+
+			link, err := os.Readlink(output("share/tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(link).To(Equal("../bin/tool"))
+		})
+
+		It("fails for paths which have been removed", func() {
+			err := extract(resource.ExtractPath{Src: "/opt/app/share/removed"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("/opt/app/share/removed: no such file or directory in the image"))
+
+			err = extract(resource.ExtractPath{Src: "/opt/app/share/hidden/file"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("/opt/app/share/hidden/file: no such file or directory in the image"))
+		})
+
+		It("fails for dests outside of the output", func() {
+			err := extract(resource.ExtractPath{Src: "/etc/config", Dest: "../config"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("../config: dest escapes the output"))
+
+			Expect(output("../config")).ToNot(BeAnExistingFile())
+		})
+
+		It("fails for dests which overlap", func() {
+			outside, err := os.MkdirTemp("", "outside-output")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(outside)
+
+			image = imageWithLayers(tarLayer(
+				layerFile("a/f", "contents"),
+				layerSymlink("b/f", filepath.Join(outside, "escaped")),
+			))
+
+			err = extract(
+				resource.ExtractPath{Src: "/a", Dest: "x"},
+				resource.ExtractPath{Src: "/b", Dest: "x"},
+			)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("dests x and x overlap"))
+
+			err = extract(
+				resource.ExtractPath{Src: "/b", Dest: "x"},
+				resource.ExtractPath{Src: "/a/f", Dest: "x/f"},
+			)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("dests x and x/f overlap"))
+
+			Expect(filepath.Join(outside, "escaped")).ToNot(BeAnExistingFile())
+		})
+
+		It("fails for dests which overlap the version's files", func() {
+			image = imageWithLayers(tarLayer(
+				layerFile("app/tag", "contents"),
+				layerFile("app/config", "contents"),
+			))
+
+			err := extract(resource.ExtractPath{Src: "/app/tag"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("dest tag overlaps the version's tag file"))
+
+			err = extract(resource.ExtractPath{Src: "/app/config", Dest: "digest"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("dest digest overlaps the version's digest file"))
+
+			err = extract(resource.ExtractPath{Src: "/app", Dest: "."})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("dest . overlaps the version's digest file"))
+		})
+
+		It("replaces symlinks in the output rather than writing through them", func() {
+			outside, err := os.MkdirTemp("", "outside-output")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(outside)
+
+			Expect(os.Symlink(filepath.Join(outside, "escaped"), output("config"))).To(Succeed())
+
+			Expect(extract(resource.ExtractPath{Src: "/etc/config"})).To(Succeed())
+
+			Expect(cat(output("config"))).To(Equal("config v2"))
+			Expect(filepath.Join(outside, "escaped")).ToNot(BeAnExistingFile())
+		})
+
+		It("respects an opaque root", func() {
+			image = imageWithLayers(
+				tarLayer(layerFile("etc/config", "config v1")),
+				tarLayer(layerFile(".wh..wh..opq", ""), layerFile("other", "other")),
+			)
+
+			err := extract(resource.ExtractPath{Src: "/etc/config"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("/etc/config: no such file or directory in the image"))
+
+			Expect(extract(resource.ExtractPath{Src: "/", Dest: "all"})).To(Succeed())
+			Expect(cat(output("all/other"))).To(Equal("other"))
+			Expect(output("all/etc")).ToNot(BeAnExistingFile())
+		})
+
+		It("fails without any paths to extract", func() {
+			err := extract()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no paths to extract"))
+		})
+	})
+
+	Context("with platforms", func() {
+		platformImage := func(platform v1.Platform) v1.Image {
+			image := imageWithLayers(tarLayer(layerFile("platform", platform.String())))
+
+			config, err := image.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+
+			config = config.DeepCopy()
+			config.OS = platform.OS
+			config.Architecture = platform.Architecture
+			config.Variant = platform.Variant
+			config.Config.Labels = map[string]string{"platform": platform.String()}
+			config.Config.Env = []string{"PLATFORM=" + platform.String()}
+
+			image, err = mutate.ConfigFile(image, config)
+			Expect(err).ToNot(HaveOccurred())
+
+			return image
+		}
+
+		pushIndex := func(platforms ...v1.Platform) resource.InRequest {
+			var index v1.ImageIndex = empty.Index
+			for _, platform := range platforms {
+				index = mutate.AppendManifests(index, mutate.IndexAddendum{
+					Add: platformImage(platform),
+					Descriptor: v1.Descriptor{
+						Platform: &platform,
+					},
+				})
+			}
+
+			tag, err := name.NewTag(repo + ":latest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remote.WriteIndex(tag, index)).To(Succeed())
+
+			digest, err := index.Digest()
+			Expect(err).ToNot(HaveOccurred())
+
+			return resource.InRequest{
+				Source: resource.Source{
+					Repository: repo,
+				},
+				Version: resource.Version{
+					Tag:    "latest",
+					Digest: digest.String(),
+				},
+			}
+		}
+
+		amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+		arm64 := v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+		s390x := v1.Platform{OS: "linux", Architecture: "s390x"}
+
+		It("writes each platform's image into its own directory", func() {
+			req := pushIndex(amd64, arm64, s390x)
+			req.Params.Platforms = []string{"linux/amd64", "linux/arm64/v8"}
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			Expect(cat(filepath.Join(destDir, "linux-amd64", "rootfs", "platform"))).To(Equal("linux/amd64"))
+			Expect(cat(filepath.Join(destDir, "linux-arm64-v8", "rootfs", "platform"))).To(Equal("linux/arm64/v8"))
+			Expect(filepath.Join(destDir, "linux-s390x")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(destDir, "rootfs")).ToNot(BeAnExistingFile())
+
+			Expect(cat(filepath.Join(destDir, "linux-amd64", "labels.json"))).To(MatchJSON(`{"platform":"linux/amd64"}`))
+			Expect(cat(filepath.Join(destDir, "linux-arm64-v8", "labels.json"))).To(MatchJSON(`{"platform":"linux/arm64/v8"}`))
+			Expect(cat(filepath.Join(destDir, "linux-arm64-v8", "metadata.json"))).To(ContainSubstring(`"PLATFORM=linux/arm64/v8"`))
+
+			Expect(cat(filepath.Join(destDir, "digest"))).To(Equal(req.Version.Digest))
+		})
+
+		It("writes each platform's image in the oci format", func() {
+			req := pushIndex(amd64, arm64)
+			req.Params.RawFormat = "oci"
+			req.Params.Platforms = []string{"linux/amd64", "linux/arm64/v8"}
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			for _, platform := range []v1.Platform{amd64, arm64} {
+				dir := strings.ReplaceAll(platform.String(), "/", "-")
+
+				image, err := tarball.ImageFromPath(filepath.Join(destDir, dir, "image.tar"), nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				config, err := image.ConfigFile()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(config.Architecture).To(Equal(platform.Architecture))
+			}
+		})
+
+		It("writes the image of each variant of an architecture", func() {
+			armv6 := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}
+			armv7 := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+			req := pushIndex(armv6, armv7)
+			req.Params.Platforms = []string{"linux/arm/v7", "linux/arm/v6"}
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			Expect(cat(filepath.Join(destDir, "linux-arm-v6", "rootfs", "platform"))).To(Equal("linux/arm/v6"))
+			Expect(cat(filepath.Join(destDir, "linux-arm-v7", "rootfs", "platform"))).To(Equal("linux/arm/v7"))
+		})
+
+		It("fails if the index doesn't have a platform", func() {
+			req := pushIndex(amd64)
+			req.Params.Platforms = []string{"linux/amd64", "linux/arm64"}
+
+			err := runIn(destDir, req)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("get linux/arm64 image"))
+		})
+
+		It("fails if a single image isn't for the platform", func() {
+			req := push(platformImage(amd64))
+			req.Params.Platforms = []string{"linux/arm64"}
+
+			err := runIn(destDir, req)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no image for platform linux/arm64: image is for linux/amd64"))
+		})
+
+		It("fails if a single image isn't for the variant", func() {
+			req := push(platformImage(v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}))
+			req.Params.Platforms = []string{"linux/arm/v7"}
+
+			err := runIn(destDir, req)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no image for platform linux/arm/v7: image is for linux/arm/v6"))
+		})
+
+		It("rejects platforms without an architecture", func() {
+			req := pushIndex(amd64)
+			req.Params.Platforms = []string{"linux"}
+
+			err := runIn(destDir, req)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`platform "linux" must have an OS and architecture`))
+		})
+	})
+
+	Context("with hostile layers", func() {
+		// the entries of a layer, given a directory outside of the rootfs
+		type hostileLayer func(outside string) []layerEntry
+
+		var outside string
+
+		BeforeEach(func() {
+			var err error
+			outside, err = os.MkdirTemp("", "outside-rootfs")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(destDir, "victim"), []byte("victim"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(outside)).To(Succeed())
+		})
+
+		expectConfined := func() {
+			Expect(filepath.Join(outside, "escaped")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(destDir, "escaped")).ToNot(BeAnExistingFile())
+
+			Expect(cat(filepath.Join(destDir, "victim"))).To(Equal("victim"))
+			Expect(cat(filepath.Join(outside, "secret"))).To(Equal("secret"))
+
+			stat, err := os.Stat(filepath.Join(outside, "secret"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat.Sys().(*syscall.Stat_t).Nlink).To(BeEquivalentTo(1))
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0644)))
+		}
+
+		DescribeTable("rejects entries which escape the rootfs",
+			func(layer hostileLayer, message string) {
+				err := runIn(destDir, push(imageWithLayers(tarLayer(layer(outside)...))))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(message))
+
+				expectConfined()
+			},
+			Entry("a relative path", func(string) []layerEntry {
+				return []layerEntry{layerFile("../escaped", "escaped")}
+			}, "../escaped: path escapes the rootfs"),
+			Entry("a path climbing out of a directory", func(string) []layerEntry {
+				return []layerEntry{layerFile("dir/../../escaped", "escaped")}
+			}, "dir/../../escaped: path escapes the rootfs"),
+			Entry("an absolute path climbing out of the root", func(string) []layerEntry {
+				return []layerEntry{layerFile("/../escaped", "escaped")}
+			}, "/../escaped: path escapes the rootfs"),
+			Entry("a whiteout", func(string) []layerEntry {
+				return []layerEntry{layerFile("../.wh.victim", "")}
+			}, "../.wh.victim: path escapes the rootfs"),
+			Entry("an opaque whiteout", func(string) []layerEntry {
+				return []layerEntry{layerFile("../.wh..wh..opq", "")}
+			}, "../.wh..wh..opq: path escapes the rootfs"),
+			Entry("a whiteout of its own directory", func(string) []layerEntry {
+				return []layerEntry{layerFile(".wh..", "")}
+			}, ".wh..: invalid whiteout"),
+			Entry("a whiteout of the directory above", func(string) []layerEntry {
+				return []layerEntry{layerFile(".wh...", "")}
+			}, ".wh...: invalid whiteout"),
+			Entry("a nested whiteout of the directory above", func(string) []layerEntry {
+				return []layerEntry{layerFile("dir/.wh...", "")}
+			}, "dir/.wh...: invalid whiteout"),
+			Entry("an empty whiteout", func(string) []layerEntry {
+				return []layerEntry{layerFile(".wh.", "")}
+			}, ".wh.: invalid whiteout"),
+			Entry("a hardlink to a relative path", func(string) []layerEntry {
+				return []layerEntry{layerHardlink("stolen", "../victim")}
+			}, "stolen: hardlink to ../victim escapes the rootfs"),
+			Entry("a hardlink to an absolute path", func(outside string) []layerEntry {
+				return []layerEntry{layerHardlink("stolen", "/.."+outside+"/secret")}
+			}, "escapes the rootfs"),
+			Entry("a hardlink through a symlink", func(outside string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("dir", outside),
+					layerHardlink("stolen", "dir/secret"),
+				}
+			}, "no such file or directory"),
+			Entry("a symlink loop", func(string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("loop", "loop"),
+					layerFile("loop/escaped", "escaped"),
+				}
+			}, "too many levels of symbolic links"),
+			Entry("a file replacing the rootfs", func(string) []layerEntry {
+				return []layerEntry{layerFile(".", "escaped")}
+			}, "the rootfs can only be a directory"),
+		)
+
+		DescribeTable("resolves symlinks within the rootfs",
+			func(layer hostileLayer, inside func(outside string) string) {
+				Expect(runIn(destDir, push(imageWithLayers(tarLayer(layer(outside)...))))).To(Succeed())
+
+				expectConfined()
+
+				if inside != nil {
+					Expect(cat(rootfs(inside(outside)))).To(Equal("escaped"))
+				}
+			},
+			Entry("a relative symlink climbing out", func(string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("link", "../../.."),
+					layerFile("link/escaped", "escaped"),
+				}
+			}, func(string) string { return "escaped" }),
+			Entry("an absolute symlink", func(outside string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("link", outside),
+					layerFile("link/escaped", "escaped"),
+				}
+			}, func(outside string) string { return filepath.Join(outside, "escaped") }),
+			Entry("a chain of symlinks", func(string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("a", "b"),
+					layerSymlink("b", "/c/../.."),
+					layerFile("a/escaped", "escaped"),
+				}
+			}, func(string) string { return "escaped" }),
+			Entry("a symlink to a symlinked directory", func(outside string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("dir", outside),
+					layerSymlink("dir/link", "/.."),
+					layerFile("dir/link/escaped", "escaped"),
+				}
+			}, func(string) string { return "escaped" }),
+			Entry("a whiteout through a symlink", func(outside string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("dir", outside),
+					layerFile("dir/.wh.secret", ""),
+				}
+			}, nil),
+			Entry("a whiteout through a symlink climbing out", func(string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("dir", ".."),
+					layerFile("dir/.wh.victim", ""),
+				}
+			}, nil),
+			Entry("an opaque whiteout through a symlink", func(outside string) []layerEntry {
+				return []layerEntry{
+					layerSymlink("dir", outside),
+					layerFile("dir/.wh..wh..opq", ""),
+				}
+			}, nil),
+			Entry("a hardlink through a symlink climbing out", func(string) []layerEntry {
+				return []layerEntry{
+					layerFile("target", "escaped"),
+					layerSymlink("dir", "../.."),
+					layerHardlink("dir/escaped", "dir/target"),
+				}
+			}, func(string) string { return "escaped" }),
+		)
+	})
+
+	Context("with extended attributes", func() {
+		withXattrs := func(entry layerEntry, xattrs map[string]string) layerEntry {
+			entry.PAXRecords = map[string]string{}
+			for name, value := range xattrs {
+				entry.PAXRecords["SCHILY.xattr."+name] = value
+			}
+
+			return entry
+		}
+
+		getXattr := func(path string, name string) string {
+			buf := make([]byte, 1024)
+			n, err := unix.Lgetxattr(path, name, buf)
+			Expect(err).ToNot(HaveOccurred())
+			return string(buf[:n])
+		}
+
+		It("restores them", func() {
+			image := imageWithLayers(tarLayer(
+				withXattrs(layerFile("some-file", "present"), map[string]string{
+					"user.some-attr":  "some-value",
+					"user.other-attr": "other-value",
+				}),
+			))
+
+			Expect(runIn(destDir, push(image))).To(Succeed())
+
+			Expect(getXattr(rootfs("some-file"), "user.some-attr")).To(Equal("some-value"))
+			Expect(getXattr(rootfs("some-file"), "user.other-attr")).To(Equal("other-value"))
+		})
+
+		It("restores file capabilities of files which are chowned", func() {
+			if os.Getuid() != 0 {
+				Skip("must be root to set file capabilities")
+			}
+
+			// VFS_CAP_REVISION_2 with CAP_NET_RAW permitted and effective
+			capability := string([]byte{
+				0x01, 0x00, 0x00, 0x02,
+				0x00, 0x20, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+			})
+
+			ping := withXattrs(layerFile("ping", "#!/bin/sh"), map[string]string{
+				"security.capability": capability,
+			})
+			ping.Uid = 1000
+			ping.Gid = 1000
+
+			Expect(runIn(destDir, push(imageWithLayers(tarLayer(ping))))).To(Succeed())
+
+			Expect(getXattr(rootfs("ping"), "security.capability")).To(Equal(capability))
+		})
+
+		Context("which can't be set", func() {
+			var image v1.Image
+
+			BeforeEach(func() {
+				image = imageWithLayers(tarLayer(
+					withXattrs(layerFile("some-file", "present"), map[string]string{
+						"unsupported.some-attr": "some-value",
+					}),
+				))
+			})
+
+			It("warns and carries on by default", func() {
+				Expect(runIn(destDir, push(image))).To(Succeed())
+				Expect(cat(rootfs("some-file"))).To(Equal("present"))
+			})
+
+			It("fails if configured to", func() {
+				req := push(image)
+				req.Params.RawXattrs = resource.XattrsFail
+
+				err := runIn(destDir, req)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("set xattr unsupported.some-attr on some-file"))
+			})
+		})
+
+		It("skips them if configured to", func() {
+			image := imageWithLayers(tarLayer(
+				withXattrs(layerFile("some-file", "present"), map[string]string{
+					"user.some-attr": "some-value",
+				}),
+			))
+
+			req := push(image)
+			req.Params.RawXattrs = resource.XattrsSkip
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			_, err := unix.Lgetxattr(rootfs("some-file"), "user.some-attr", make([]byte, 1024))
+			Expect(err).To(Equal(unix.ENODATA))
+		})
+
+		It("rejects an unknown policy", func() {
+			req := push(imageWithLayers(tarLayer(layerFile("some-file", "present"))))
+			req.Params.RawXattrs = "ignore"
+
+			err := runIn(destDir, req)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`unknown xattrs policy "ignore"`))
+		})
+	})
+
+	Context("with a cache_dir", func() {
+		var cacheDir string
+
+		BeforeEach(func() {
+			var err error
+			cacheDir, err = os.MkdirTemp("", "registry-image-cache")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(cacheDir)).To(Succeed())
+		})
+
+		cachedBlobs := func() map[string]int64 {
+			blobs := map[string]int64{}
+
+			entries, err := os.ReadDir(filepath.Join(cacheDir, "blobs", "sha256"))
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, entry := range entries {
+				info, err := entry.Info()
+				Expect(err).ToNot(HaveOccurred())
+
+				blobs["sha256:"+entry.Name()] = info.Size()
+			}
+
+			return blobs
+		}
+
+		It("reuses cached layers rather than downloading them again", func() {
+			base := tarLayer(layerFile("base", "base"))
+
+			first := imageWithLayers(base, tarLayer(layerFile("first", "first")))
+			second := imageWithLayers(base, tarLayer(layerFile("second", "second")))
+
+			req := push(first)
+			req.Source.CacheDir = cacheDir
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			baseDigest, err := base.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cachedBlobs()).To(HaveKey(baseDigest.String()))
+
+			secondReq := push(second)
+
+			// the registry can no longer serve the base layer
+			deleteBlob, err := http.NewRequest(http.MethodDelete, registryServer.URL+"/v2/test-image/blobs/"+baseDigest.String(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			res, err := http.DefaultClient.Do(deleteBlob)
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusAccepted))
+
+			Expect(runIn(destDir, secondReq)).ToNot(Succeed())
+
+			secondReq.Source.CacheDir = cacheDir
+			Expect(os.RemoveAll(filepath.Join(destDir, "rootfs"))).To(Succeed())
+			Expect(runIn(destDir, secondReq)).To(Succeed())
+
+			Expect(cat(rootfs("base"))).To(Equal("base"))
+			Expect(cat(rootfs("second"))).To(Equal("second"))
+			Expect(rootfs("first")).ToNot(BeAnExistingFile())
+		})
+
+		It("evicts layers once the cache is over its size limit", func() {
+			var layers []v1.Layer
+			for i := 0; i < 3; i++ {
+				// incompressible, so each layer is around 600KiB
+				contents := make([]byte, 600*1024)
+				_, err := rand.Read(contents)
+				Expect(err).ToNot(HaveOccurred())
+
+				layers = append(layers, tarLayer(layerFile(fmt.Sprintf("layer-%d", i), string(contents))))
+			}
+
+			req := push(imageWithLayers(layers...))
+			req.Source.CacheDir = cacheDir
+			req.Source.CacheMaxSizeMB = 1
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			for i := 0; i < 3; i++ {
+				Expect(rootfs(fmt.Sprintf("layer-%d", i))).To(BeAnExistingFile())
+			}
+
+			blobs := cachedBlobs()
+			Expect(blobs).To(HaveLen(1))
+
+			var total int64
+			for _, size := range blobs {
+				total += size
+			}
+			Expect(total).To(BeNumerically("<=", 1024*1024))
+		})
+
+		It("removes downloads abandoned by earlier runs", func() {
+			stale := filepath.Join(cacheDir, "download-stale")
+			Expect(os.WriteFile(stale, []byte("partial"), 0644)).To(Succeed())
+
+			old := time.Now().Add(-2 * time.Hour)
+			Expect(os.Chtimes(stale, old, old)).To(Succeed())
+
+			// may still be being written by a concurrent run
+			live := filepath.Join(cacheDir, "download-live")
+			Expect(os.WriteFile(live, []byte("partial"), 0644)).To(Succeed())
+
+			req := push(imageWithLayers(tarLayer(layerFile("some-file", "some-data"))))
+			req.Source.CacheDir = cacheDir
+			Expect(runIn(destDir, req)).To(Succeed())
+
+			Expect(stale).ToNot(BeAnExistingFile())
+			Expect(live).To(BeAnExistingFile())
+		})
+	})
+})
+
+// rawTaggable is a manifest to push as-is.
+type rawTaggable struct {
+	manifest  []byte
+	mediaType types.MediaType
+}
+
+func (t rawTaggable) RawManifest() ([]byte, error) { return t.manifest, nil }
+
+func (t rawTaggable) MediaType() (types.MediaType, error) { return t.mediaType, nil }
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -1080,3 +1081,165 @@ func (example SemverTagPushExample) put(req resource.OutRequest, dir string) (re
 
 	return res, nil
 }
+
+var _ = Describe("bumping aliases through a registry rewrite", func() {
+	var origin, proxy *httptest.Server
+	var srcDir string
+	var req resource.OutRequest
+
+	var repo string
+
+	BeforeEach(func() {
+		var err error
+		srcDir, err = os.MkdirTemp("", "docker-image-out-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		origin = newTestRegistry()
+		proxy = newTestRegistry()
+
+		repo = origin.Listener.Addr().String() + "/org/app"
+
+		image, err := random.Image(1024, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), nil, image)
+		Expect(err).ToNot(HaveOccurred())
+
+		// the proxy has a newer version than the one being pushed
+		pushRandomImage(proxy.Listener.Addr().String() + "/origin-proxy/org/app:2.0.0")
+
+		req = resource.OutRequest{
+			Source: resource.Source{
+				Repository: repo,
+				RegistryRewrites: []resource.RegistryRewrite{
+					{
+						Prefix:   origin.Listener.Addr().String(),
+						Location: proxy.Listener.Addr().String() + "/origin-proxy",
+					},
+				},
+			},
+			Params: resource.PutParams{
+				Image:       "image.tar",
+				Version:     "1.2.3",
+				BumpAliases: true,
+			},
+		}
+	})
+
+	AfterEach(func() {
+		origin.Close()
+		proxy.Close()
+		Expect(os.RemoveAll(srcDir)).To(Succeed())
+	})
+
+	It("lists existing tags through the rewrite but pushes to the repository", func() {
+		_, err := SemverTagPushExample{}.put(req, srcDir)
+		Expect(err).ToNot(HaveOccurred())
+
+		originRepo, err := name.NewRepository(repo)
+		Expect(err).ToNot(HaveOccurred())
+
+		tags, err := remote.List(originRepo)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(tags).To(ConsistOf("1.2.3", "1.2", "1"))
+	})
+})
+
+var _ = Describe("creating the ECR repository on put", func() {
+	var registryServer *httptest.Server
+	var ecr *fakeECR
+	var srcDir string
+	var req resource.OutRequest
+
+	BeforeEach(func() {
+		var err error
+		srcDir, err = os.MkdirTemp("", "docker-image-out-dir")
+		Expect(err).ToNot(HaveOccurred())
+
+		registryServer = newTestRegistry()
+
+		ecr = newFakeECR("https://" + registryServer.Listener.Addr().String())
+		ecr.RespondTo("CreateRepository", map[string]any{})
+		ecr.RespondTo("PutLifecyclePolicy", map[string]any{})
+
+		image, err := random.Image(1024, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		err = tarball.WriteToFile(filepath.Join(srcDir, "image.tar"), nil, image)
+		Expect(err).ToNot(HaveOccurred())
+
+		err = os.WriteFile(filepath.Join(srcDir, "lifecycle.json"), []byte(`{"rules":[]}`), 0644)
+		Expect(err).ToNot(HaveOccurred())
+
+		req = resource.OutRequest{
+			Source: resource.Source{
+				Repository: "org/new-service",
+				AwsCredentials: resource.AwsCredentials{
+					AwsAccessKeyId:     "some-access-key",
+					AwsSecretAccessKey: "some-secret-key",
+					AwsRegion:          "us-east-1",
+					AwsEcrEndpoint:     ecr.URL,
+				},
+			},
+			Params: resource.PutParams{
+				Image:   "image.tar",
+				Version: "1.0.0",
+				ECRCreateRepository: &resource.ECRRepositorySettings{
+					ImmutableTags:   true,
+					ScanOnPush:      true,
+					EncryptionType:  "KMS",
+					KmsKey:          "some-key",
+					LifecyclePolicy: "lifecycle.json",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		ecr.Close()
+		registryServer.Close()
+		Expect(os.RemoveAll(srcDir)).To(Succeed())
+	})
+
+	It("creates the repository with a lifecycle policy before pushing", func() {
+		_, err := SemverTagPushExample{}.put(req, srcDir)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ecr.Requests("CreateRepository")).To(ConsistOf(And(
+			HaveKeyWithValue("repositoryName", "org/new-service"),
+			HaveKeyWithValue("imageTagMutability", "IMMUTABLE"),
+			HaveKeyWithValue("imageScanningConfiguration", HaveKeyWithValue("scanOnPush", true)),
+			HaveKeyWithValue("encryptionConfiguration", And(
+				HaveKeyWithValue("encryptionType", "KMS"),
+				HaveKeyWithValue("kmsKey", "some-key"),
+			)),
+		)))
+
+		Expect(ecr.Requests("PutLifecyclePolicy")).To(ConsistOf(And(
+			HaveKeyWithValue("repositoryName", "org/new-service"),
+			HaveKeyWithValue("lifecyclePolicyText", `{"rules":[]}`),
+		)))
+
+		repo, err := name.NewRepository(registryServer.Listener.Addr().String() + "/org/new-service")
+		Expect(err).ToNot(HaveOccurred())
+
+		tags, err := remote.List(repo)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tags).To(ConsistOf("1.0.0"))
+	})
+
+	It("leaves an existing repository alone", func() {
+		ecr.RespondTo("CreateRepository", func(map[string]any) any {
+			return map[string]any{
+				"__type":  "RepositoryAlreadyExistsException",
+				"message": "The repository already exists",
+			}
+		})
+
+		_, err := SemverTagPushExample{}.put(req, srcDir)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ecr.Requests("PutLifecyclePolicy")).To(BeEmpty())
+	})
+})
@@ -1,18 +1,50 @@
 package resource_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/compression"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
+	"github.com/theupdateframework/notary/cryptoservice"
+	"github.com/theupdateframework/notary/passphrase"
+	"github.com/theupdateframework/notary/trustmanager"
+	"github.com/theupdateframework/notary/tuf"
+	"github.com/theupdateframework/notary/tuf/data"
+	"github.com/theupdateframework/notary/tuf/testutils"
+	"github.com/theupdateframework/notary/tuf/utils"
+
+	resource "github.com/concourse/registry-image-resource"
 )
 
 var bins struct {
@@ -149,7 +181,389 @@ func cat(path string) string {
 	return string(bytes)
 }
 
+// runIn runs the in script into destDir. Its stderr is included in the error
+// if it fails, so that specs can match on the reason.
+func runIn(destDir string, req resource.InRequest) error {
+	_, err := runScript(bins.In, req, destDir)
+	return err
+}
+
+// runCheck runs the check script. Its stderr is included in the error if it
+// fails, so that specs can match on the reason.
+func runCheck(req resource.CheckRequest) (resource.CheckResponse, error) {
+	var res resource.CheckResponse
+
+	stdout, err := runScript(bins.Check, req)
+	if err != nil {
+		return nil, err
+	}
+
+	Expect(json.Unmarshal(stdout, &res)).To(Succeed())
+
+	return res, nil
+}
+
+func runScript(path string, req any, args ...string) ([]byte, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Env = []string{"TEST=true"}
+
+	payload, err := json.Marshal(req)
+	Expect(err).ToNot(HaveOccurred())
+
+	outBuf := new(bytes.Buffer)
+	errBuf := new(bytes.Buffer)
+
+	cmd.Stdin = bytes.NewBuffer(payload)
+	cmd.Stdout = outBuf
+	cmd.Stderr = io.MultiWriter(GinkgoWriter, errBuf)
+
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%w\n\nstderr:\n\n%s", err, errBuf)
+	}
+
+	return outBuf.Bytes(), nil
+}
+
 type registryTagsResponse struct {
 	Name string   `json:"name"`
 	Tags []string `json:"tags"`
 }
+
+// newTestRegistry starts an in-memory registry which tests can push images
+// to, for cases that are too involved to fake with ghttp.
+func newTestRegistry(opts ...registry.Option) *httptest.Server {
+	opts = append([]registry.Option{registry.Logger(log.New(GinkgoWriter, "registry: ", 0))}, opts...)
+	return httptest.NewServer(registry.New(opts...))
+}
+
+func pushRandomImage(ref string) v1.Image {
+	image, err := random.Image(1024, 1)
+	Expect(err).ToNot(HaveOccurred())
+
+	pushImage(ref, image)
+
+	return image
+}
+
+func pushCreatedAt(ref string, created time.Time) v1.Image {
+	image, err := random.Image(1024, 1)
+	Expect(err).ToNot(HaveOccurred())
+
+	image, err = mutate.CreatedAt(image, v1.Time{Time: created})
+	Expect(err).ToNot(HaveOccurred())
+
+	pushImage(ref, image)
+
+	return image
+}
+
+func pushImage(ref string, image v1.Image) {
+	tag, err := name.NewTag(ref)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = remote.Write(tag, image)
+	Expect(err).ToNot(HaveOccurred())
+}
+
+func imageDigest(image v1.Image) string {
+	digest, err := image.Digest()
+	Expect(err).ToNot(HaveOccurred())
+	return digest.String()
+}
+
+// fakeECR stands in for the ECR API. Each action, named by the X-Amz-Target
+// header, responds with the JSON body registered for it, and
+// GetAuthorizationToken hands out credentials for the given proxy endpoint.
+type fakeECR struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	responses map[string]any
+	requests  map[string][]map[string]any
+}
+
+func newFakeECR(proxyEndpoint string) *fakeECR {
+	ecr := &fakeECR{
+		responses: map[string]any{
+			"GetAuthorizationToken": map[string]any{
+				"authorizationData": []any{
+					map[string]any{
+						"authorizationToken": base64.StdEncoding.EncodeToString([]byte("AWS:some-password")),
+						"proxyEndpoint":      proxyEndpoint,
+					},
+				},
+			},
+		},
+		requests: map[string][]map[string]any{},
+	}
+
+	ecr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer GinkgoRecover()
+
+		action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonEC2ContainerRegistry_V20150921.")
+
+		var input map[string]any
+		Expect(json.NewDecoder(r.Body).Decode(&input)).To(Succeed())
+
+		ecr.lock.Lock()
+		ecr.requests[action] = append(ecr.requests[action], input)
+		response, found := ecr.responses[action]
+		ecr.lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+		if !found {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"__type":  "InvalidParameterException",
+				"message": "unexpected action " + action,
+			})
+			return
+		}
+
+		if respond, ok := response.(func(map[string]any) any); ok {
+			response = respond(input)
+		}
+
+		if body, ok := response.(map[string]any); ok && body["__type"] != nil {
+			// an error, e.g. RepositoryAlreadyExistsException
+			w.WriteHeader(http.StatusBadRequest)
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	return ecr
+}
+
+// RespondTo sets the JSON body returned for an action, or a function of the
+// request input which returns it.
+func (ecr *fakeECR) RespondTo(action string, response any) {
+	ecr.lock.Lock()
+	defer ecr.lock.Unlock()
+	ecr.responses[action] = response
+}
+
+// Requests returns the inputs received for an action.
+func (ecr *fakeECR) Requests(action string) []map[string]any {
+	ecr.lock.Lock()
+	defer ecr.lock.Unlock()
+	return ecr.requests[action]
+}
+
+// fakeNotary serves the trust data of a single collection, in which the
+// targets role signs a digest for each tag.
+type fakeNotary struct {
+	*httptest.Server
+
+	// the ID of the collection's root key, and the PEM-encoded CA which
+	// issued its certificate
+	RootKeyID string
+	RootCA    string
+}
+
+func newFakeNotary(gun string, signed map[string]string) *fakeNotary {
+	cs := cryptoservice.NewCryptoService(trustmanager.NewKeyMemoryStore(passphrase.ConstantRetriever("")))
+
+	start := time.Now().AddDate(0, 0, -1)
+	end := start.AddDate(1, 0, 0)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	caTemplate, err := utils.NewCertificate("notary root CA", start, end)
+	Expect(err).ToNot(HaveOccurred())
+	caTemplate.IsCA = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	caTemplate.ExtKeyUsage = nil
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	caCert, err := x509.ParseCertificate(caDER)
+	Expect(err).ToNot(HaveOccurred())
+
+	rootKey, err := cs.Create(data.CanonicalRootRole, data.GUN(gun), data.ECDSAKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	rootPrivateKey, _, err := cs.GetPrivateKey(rootKey.ID())
+	Expect(err).ToNot(HaveOccurred())
+
+	rootTemplate, err := utils.NewCertificate(gun, start, end)
+	Expect(err).ToNot(HaveOccurred())
+	rootTemplate.ExtKeyUsage = nil
+
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, caCert, rootPrivateKey.CryptoSigner().Public(), caKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	rootCert, err := x509.ParseCertificate(rootDER)
+	Expect(err).ToNot(HaveOccurred())
+
+	roles := map[data.RoleName]data.BaseRole{}
+	roles[data.CanonicalRootRole] = data.NewBaseRole(data.CanonicalRootRole, 1, data.NewECDSAx509PublicKey(utils.CertToPEM(rootCert)))
+
+	for _, role := range []data.RoleName{data.CanonicalTargetsRole, data.CanonicalSnapshotRole, data.CanonicalTimestampRole} {
+		key, err := cs.Create(role, data.GUN(gun), data.ECDSAKey)
+		Expect(err).ToNot(HaveOccurred())
+
+		roles[role] = data.NewBaseRole(role, 1, key)
+	}
+
+	repo := tuf.NewRepo(cs)
+	Expect(repo.InitRoot(
+		roles[data.CanonicalRootRole],
+		roles[data.CanonicalTimestampRole],
+		roles[data.CanonicalSnapshotRole],
+		roles[data.CanonicalTargetsRole],
+		false,
+	)).To(Succeed())
+
+	_, err = repo.InitTargets(data.CanonicalTargetsRole)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(repo.InitSnapshot()).To(Succeed())
+	Expect(repo.InitTimestamp()).To(Succeed())
+
+	for tag, digest := range signed {
+		hash, err := v1.NewHash(digest)
+		Expect(err).ToNot(HaveOccurred())
+
+		sum, err := hex.DecodeString(hash.Hex)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = repo.AddTargets(data.CanonicalTargetsRole, data.Files{
+			tag: data.FileMeta{Length: 1024, Hashes: data.Hashes{"sha256": sum}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	metadata, err := testutils.SignAndSerialize(repo)
+	Expect(err).ToNot(HaveOccurred())
+
+	notary := &fakeNotary{
+		RootKeyID: roles[data.CanonicalRootRole].ListKeyIDs()[0],
+		RootCA:    string(utils.CertToPEM(caCert)),
+	}
+
+	prefix := "/v2/" + gun + "/_trust/tuf/"
+	notary.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+
+		// roles are fetched by name, or by consistent name, e.g.
+		// snapshot.<sha256>.json; versioned roots such as 2.root.json are
+		// not served, as the root is never rotated
+		file := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), ".json")
+		role, _, _ := strings.Cut(file, ".")
+
+		body, found := metadata[data.RoleName(role)]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write(body)
+	}))
+
+	return notary
+}
+
+// CACert returns the PEM-encoded certificate of the server, for ca_certs.
+func (notary *fakeNotary) CACert() string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: notary.Certificate().Raw,
+	}))
+}
+
+// layerEntry is an entry in a layer built by tarLayer.
+type layerEntry struct {
+	tar.Header
+	Contents string
+}
+
+func layerFile(name string, contents string) layerEntry {
+	return layerEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+		},
+		Contents: contents,
+	}
+}
+
+func layerSymlink(name string, target string) layerEntry {
+	return layerEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     name,
+			Linkname: target,
+			Mode:     0777,
+		},
+	}
+}
+
+func layerHardlink(name string, target string) layerEntry {
+	return layerEntry{
+		Header: tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     name,
+			Linkname: target,
+			Mode:     0644,
+		},
+	}
+}
+
+// tarLayer builds a gzipped layer from the entries, in order.
+func tarLayer(entries ...layerEntry) v1.Layer {
+	return compressedTarLayer(compression.GZip, entries...)
+}
+
+// compressedTarLayer builds a layer from the entries, in order, compressed
+// with the given algorithm.
+func compressedTarLayer(algorithm compression.Compression, entries ...layerEntry) v1.Layer {
+	contents := tarContents(entries...)
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(contents)), nil
+	}, tarball.WithCompression(algorithm))
+	Expect(err).ToNot(HaveOccurred())
+
+	return layer
+}
+
+// tarContents builds an uncompressed tar from the entries, in order.
+func tarContents(entries ...layerEntry) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for _, entry := range entries {
+		hdr := entry.Header
+		hdr.Size = int64(len(entry.Contents))
+
+		Expect(tw.WriteHeader(&hdr)).To(Succeed())
+
+		_, err := tw.Write([]byte(entry.Contents))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	Expect(tw.Close()).To(Succeed())
+
+	return buf.Bytes()
+}
+
+// imageWithLayers builds an image from the layers, in order.
+func imageWithLayers(layers ...v1.Layer) v1.Image {
+	image, err := mutate.AppendLayers(empty.Image, layers...)
+	Expect(err).ToNot(HaveOccurred())
+
+	return image
+}
@@ -10,9 +10,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -66,6 +68,12 @@ type AwsCredentials struct {
 	AwsRoleArn       string   `json:"aws_role_arn,omitempty"`
 	AwsRoleArns      []string `json:"aws_role_arns,omitempty"`
 	AwsAccountId     string   `json:"aws_account_id,omitempty"`
+
+	// Overrides the ECR API endpoint, e.g. for a VPC interface endpoint.
+	AwsEcrEndpoint string `json:"aws_ecr_endpoint,omitempty"`
+
+	// List tags with the ECR DescribeImages API instead of the registry API.
+	AwsEcrDescribeImages bool `json:"aws_ecr_describe_images,omitempty"`
 }
 
 type BasicCredentials struct {
@@ -76,9 +84,77 @@ type BasicCredentials struct {
 type RegistryMirror struct {
 	Host string `json:"host,omitempty"`
 
+	// Registries this mirror serves, matched with path.Match (e.g.
+	// "*.gcr.io"). Defaults to Docker Hub.
+	Registries []string `json:"registries,omitempty"`
+
+	// Fail rather than moving on to the next mirror or the origin when the
+	// mirror cannot be used.
+	Fatal bool `json:"fatal,omitempty"`
+
+	// Copy images into the mirror when they had to be fetched from the
+	// origin, so that the mirror can act as a pull-through cache.
+	Populate bool `json:"populate,omitempty"`
+
+	// Compare the mirror against the origin, either logging or failing when
+	// they diverge.
+	Verify string `json:"verify,omitempty"`
+
+	BasicCredentials
+}
+
+const (
+	MirrorVerifyWarn = "warn"
+	MirrorVerifyFail = "fail"
+)
+
+// Serves reports whether the mirror should be used for repositories in the
+// given registry.
+func (mirror RegistryMirror) Serves(registry name.Registry) (bool, error) {
+	if len(mirror.Registries) == 0 {
+		// only use registry_mirror for the default registry so that a mirror can
+		// be configured as a global default
+		//
+		// note that this matches the behavior of the `docker` CLI
+		return registry.String() == name.DefaultRegistry, nil
+	}
+
+	for _, pattern := range mirror.Registries {
+		if pattern == "docker.io" {
+			pattern = name.DefaultRegistry
+		}
+
+		matched, err := path.Match(pattern, registry.RegistryStr())
+		if err != nil {
+			return false, fmt.Errorf("invalid registry pattern %q: %w", pattern, err)
+		}
+
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RegistryRewrite redirects reads of repositories whose fully qualified name
+// starts with Prefix to Location, in the style of registries.conf. This
+// allows pulling through proxy caches which serve an upstream registry under
+// a project path, e.g. docker.io/ => harbor.local/dockerhub-proxy/.
+type RegistryRewrite struct {
+	Prefix   string `json:"prefix"`
+	Location string `json:"location"`
+
 	BasicCredentials
 }
 
+// MirrorSource is a copy of a Source which points to one of its mirrors.
+type MirrorSource struct {
+	Source
+
+	Mirror RegistryMirror
+}
+
 type PlatformField struct {
 	Architecture string `json:"architecture,omitempty"`
 	OS           string `json:"os,omitempty"`
@@ -87,6 +163,10 @@ type PlatformField struct {
 type Source struct {
 	Repository string `json:"repository"`
 
+	// Additional repositories whose semver tags are merged with those of
+	// Repository into a single version stream.
+	Repositories []string `json:"repositories,omitempty"`
+
 	Insecure bool `json:"insecure"`
 
 	PreReleases        bool     `json:"pre_releases,omitempty"`
@@ -95,15 +175,36 @@ type Source struct {
 
 	SemverConstraint string `json:"semver_constraint,omitempty"`
 
+	TagIncludeRegex string `json:"tag_include_regex,omitempty"`
+	TagExcludeRegex string `json:"tag_exclude_regex,omitempty"`
+
 	Tag Tag `json:"tag,omitempty"`
 
+	ReferrersOf *ReferrersOf `json:"referrers_of,omitempty"`
+
+	// Emit a new version of the tag whenever the tag of its base image, as
+	// recorded by the OCI base image annotations, moves.
+	TrackBaseImage bool `json:"track_base_image,omitempty"`
+
 	Regex         string `json:"tag_regex,omitempty"`
 	CreatedAtSort bool   `json:"created_at_sort,omitempty"`
+	PushedAtSort  bool   `json:"pushed_at_sort,omitempty"`
+
+	// Only emit versions created at least MinAge ago, and at most MaxAge ago.
+	MinAge Duration `json:"min_age,omitempty"`
+	MaxAge Duration `json:"max_age,omitempty"`
 
 	BasicCredentials
 	AwsCredentials
 
-	RegistryMirror *RegistryMirror `json:"registry_mirror,omitempty"`
+	RegistryMirror  *RegistryMirror  `json:"registry_mirror,omitempty"`
+	RegistryMirrors []RegistryMirror `json:"registry_mirrors,omitempty"`
+
+	RegistryRewrites []RegistryRewrite `json:"registry_rewrites,omitempty"`
+
+	ScanGate *ScanGate `json:"scan_gate,omitempty"`
+
+	VerifySignatures *VerifySignatures `json:"verify_signatures,omitempty"`
 
 	ContentTrust *ContentTrust `json:"content_trust,omitempty"`
 
@@ -111,44 +212,136 @@ type Source struct {
 
 	RawPlatform *PlatformField `json:"platform,omitempty"`
 
+	// Directory in which to cache downloaded layers by digest, e.g. on a
+	// volume shared between containers, and its size limit.
+	CacheDir       string `json:"cache_dir,omitempty"`
+	CacheMaxSizeMB int64  `json:"cache_max_size_mb,omitempty"`
+
 	Debug bool `json:"debug,omitempty"`
+
+	// set by AuthenticateToECR, for talking to the ECR API
+	ecrClient *ecr.Client
 }
 
-func (source Source) Mirror() (Source, bool, error) {
-	if source.RegistryMirror == nil {
-		return Source{}, false, nil
+// Mirrors returns a copy of the source for each mirror which serves its
+// registry, in the order in which they should be tried.
+func (source Source) Mirrors() ([]MirrorSource, error) {
+	var mirrors []RegistryMirror
+	if source.RegistryMirror != nil {
+		mirrors = append(mirrors, *source.RegistryMirror)
+	}
+
+	mirrors = append(mirrors, source.RegistryMirrors...)
+
+	if len(mirrors) == 0 {
+		return nil, nil
 	}
 
 	repo, err := name.NewRepository(source.Repository)
 	if err != nil {
-		return Source{}, false, fmt.Errorf("parse repository: %w", err)
+		return nil, fmt.Errorf("parse repository: %w", err)
 	}
 
-	if repo.Registry.String() != name.DefaultRegistry {
-		// only use registry_mirror for the default registry so that a mirror can
-		// be configured as a global default
-		//
-		// note that this matches the behavior of the `docker` CLI
-		return Source{}, false, nil
+	var sources []MirrorSource
+	for _, mirror := range mirrors {
+		switch mirror.Verify {
+		case "", MirrorVerifyWarn, MirrorVerifyFail:
+		default:
+			return nil, fmt.Errorf("invalid verify policy %q for mirror %s: must be %q or %q", mirror.Verify, mirror.Host, MirrorVerifyWarn, MirrorVerifyFail)
+		}
+
+		serves, err := mirror.Serves(repo.Registry)
+		if err != nil {
+			return nil, err
+		}
+
+		if !serves {
+			continue
+		}
+
+		// resolve implicit namespace by re-parsing .Name()
+		mirrorRepo, err := name.NewRepository(repo.Name())
+		if err != nil {
+			return nil, fmt.Errorf("resolve implicit namespace: %w", err)
+		}
+
+		mirrorRepo.Registry, err = name.NewRegistry(mirror.Host)
+		if err != nil {
+			return nil, fmt.Errorf("parse mirror registry: %w", err)
+		}
+
+		copy := source
+		copy.Repository = mirrorRepo.Name()
+		copy.BasicCredentials = mirror.BasicCredentials
+		copy.RegistryMirror = nil
+		copy.RegistryMirrors = nil
+		copy.ecrClient = nil
+
+		sources = append(sources, MirrorSource{
+			Source: copy,
+			Mirror: mirror,
+		})
 	}
 
-	// resolve implicit namespace by re-parsing .Name()
-	mirror, err := name.NewRepository(repo.Name())
-	if err != nil {
-		return Source{}, false, fmt.Errorf("resolve implicit namespace: %w", err)
+	return sources, nil
+}
+
+// Rewrite returns a copy of the source which reads from the location of the
+// longest matching registry rewrite prefix. The source is returned as-is if
+// no rewrite matches.
+func (source Source) Rewrite() (Source, error) {
+	if len(source.RegistryRewrites) == 0 {
+		return source, nil
 	}
 
-	mirror.Registry, err = name.NewRegistry(source.RegistryMirror.Host)
+	repo, err := name.NewRepository(source.Repository)
 	if err != nil {
-		return Source{}, false, fmt.Errorf("parse mirror registry: %w", err)
+		return Source{}, fmt.Errorf("parse repository: %w", err)
+	}
+
+	fullName := canonicalName(repo)
+
+	var match *RegistryRewrite
+	var matchPrefix string
+	for i, rewrite := range source.RegistryRewrites {
+		prefix := strings.TrimSuffix(rewrite.Prefix, "/")
+		if strings.HasPrefix(prefix, "index.docker.io") {
+			prefix = "docker.io" + strings.TrimPrefix(prefix, "index.docker.io")
+		}
+
+		if fullName != prefix && !strings.HasPrefix(fullName, prefix+"/") {
+			continue
+		}
+
+		if match == nil || len(prefix) > len(matchPrefix) {
+			match = &source.RegistryRewrites[i]
+			matchPrefix = prefix
+		}
+	}
+
+	if match == nil {
+		return source, nil
 	}
 
 	copy := source
-	copy.Repository = mirror.Name()
-	copy.BasicCredentials = source.RegistryMirror.BasicCredentials
-	copy.RegistryMirror = nil
+	copy.Repository = strings.TrimSuffix(match.Location, "/") + strings.TrimPrefix(fullName, matchPrefix)
+	copy.BasicCredentials = match.BasicCredentials
+	copy.RegistryRewrites = nil
+	copy.ecrClient = nil
 
-	return copy, true, nil
+	logrus.Debugf("rewrote %s to %s", source.Repository, copy.Repository)
+
+	return copy, nil
+}
+
+// canonicalName returns the fully qualified name of the repository, with
+// Docker Hub referred to as docker.io, e.g. docker.io/library/alpine.
+func canonicalName(repo name.Repository) string {
+	if repo.RegistryStr() == name.DefaultRegistry {
+		return "docker.io/" + repo.RepositoryStr()
+	}
+
+	return repo.Name()
 }
 
 type Options struct {
@@ -179,17 +372,38 @@ func (source Source) SetOptions(opts *Options) error {
 }
 
 func (source Source) AuthOptions(repo name.Repository, scopeActions []string) ([]remote.Option, error) {
-	ctx := context.Background()
-	var auth authn.Authenticator
+	auth := source.Authenticator()
+
+	rt, err := source.Transport(repo, scopeActions)
+	if err != nil {
+		return nil, err
+	}
+
+	plat := source.Platform()
+	v1plat := v1.Platform{
+		Architecture: plat.Architecture,
+		OS:           plat.OS,
+	}
+
+	return []remote.Option{remote.WithAuth(auth), remote.WithTransport(rt), remote.WithPlatform(v1plat)}, nil
+}
+
+func (source Source) Authenticator() authn.Authenticator {
 	if source.Username != "" && source.Password != "" {
-		auth = &authn.Basic{
+		return &authn.Basic{
 			Username: source.Username,
 			Password: source.Password,
 		}
-	} else {
-		auth = authn.Anonymous
 	}
 
+	return authn.Anonymous
+}
+
+// Transport returns a transport which is authenticated against the
+// repository's registry, for requests not covered by the remote package.
+func (source Source) Transport(repo name.Repository, scopeActions []string) (http.RoundTripper, error) {
+	ctx := context.Background()
+
 	tr := http.DefaultTransport.(*http.Transport)
 	// a cert was provided
 	if len(source.DomainCerts) > 0 {
@@ -221,18 +435,12 @@ func (source Source) AuthOptions(repo name.Repository, scopeActions []string) ([
 		scopes[i] = repo.Scope(action)
 	}
 
-	rt, err := transport.NewWithContext(ctx, repo.Registry, auth, tr, scopes)
+	rt, err := transport.NewWithContext(ctx, repo.Registry, source.Authenticator(), tr, scopes)
 	if err != nil {
 		return nil, fmt.Errorf("initialize transport: %w", err)
 	}
 
-	plat := source.Platform()
-	v1plat := v1.Platform{
-		Architecture: plat.Architecture,
-		OS:           plat.OS,
-	}
-
-	return []remote.Option{remote.WithAuth(auth), remote.WithTransport(rt), remote.WithPlatform(v1plat)}, nil
+	return rt, nil
 }
 
 func (source *Source) Platform() PlatformField {
@@ -255,6 +463,17 @@ func (source *Source) Platform() PlatformField {
 	return *p
 }
 
+// CheckedRepositories returns every repository that check should consider,
+// in the order they are configured.
+func (source Source) CheckedRepositories() []string {
+	var repos []string
+	if source.Repository != "" {
+		repos = append(repos, source.Repository)
+	}
+
+	return append(repos, source.Repositories...)
+}
+
 func (source Source) NewRepository() (name.Repository, error) {
 	return name.NewRepository(source.Repository, source.RepositoryOptions()...)
 }
@@ -267,6 +486,26 @@ func (source Source) RepositoryOptions() []name.Option {
 	return opts
 }
 
+// ReferrersOf configures check to emit the artifacts which refer to a tag,
+// such as SBOMs and attestations, rather than the tag itself.
+type ReferrersOf struct {
+	// The tag of the subject image.
+	Tag Tag `json:"tag"`
+
+	// Only emit artifacts of these types. All are emitted if empty.
+	ArtifactTypes []string `json:"artifact_types,omitempty"`
+}
+
+// VerifySignatures configures check to only emit versions with a cosign
+// signature.
+type VerifySignatures struct {
+	// PEM-encoded public keys; a signature by any one of them is accepted.
+	PublicKeys []string `json:"public_keys"`
+
+	// Annotations which the signature payload must carry.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
 type ContentTrust struct {
 	Server               string `json:"server"`
 	RepositoryKeyID      string `json:"repository_key_id"`
@@ -276,9 +515,28 @@ type ContentTrust struct {
 	TLSCert              string `json:"tls_cert"`
 	Scopes               string `json:"scopes,omitempty"`
 
+	// Refuse to fetch a version unless its digest is the one signed for its
+	// tag.
+	Verify bool `json:"verify,omitempty"`
+
+	// Also only emit versions from check whose digest is the one signed for
+	// their tag.
+	VerifyOnCheck bool `json:"verify_on_check,omitempty"`
+
+	// IDs of the root keys of the trusted collection, and/or a PEM-encoded
+	// CA which must have issued its root certificate. Verifying requires
+	// either, so that the root is never trusted on first use.
+	RootKeyIDs []string `json:"root_key_ids,omitempty"`
+	RootCA     string   `json:"root_ca,omitempty"`
+
 	BasicCredentials
 }
 
+// Pinned returns whether the root of the trusted collection is pinned.
+func (ct *ContentTrust) Pinned() bool {
+	return len(ct.RootKeyIDs) > 0 || ct.RootCA != ""
+}
+
 /*
 	Create notary config directory with following structure
 
@@ -420,7 +678,11 @@ func (source *Source) AuthenticateToECR() bool {
 		)
 	}
 
-	client := ecr.NewFromConfig(awsConfig)
+	client := ecr.NewFromConfig(awsConfig, func(o *ecr.Options) {
+		if source.AwsEcrEndpoint != "" {
+			o.BaseEndpoint = aws.String(source.AwsEcrEndpoint)
+		}
+	})
 	result, err := client.GetAuthorizationToken(context.TODO(), &ecr.GetAuthorizationTokenInput{})
 	if err != nil {
 		logrus.Errorf("failed to authenticate to ECR: %s", err)
@@ -451,6 +713,7 @@ func (source *Source) AuthenticateToECR() bool {
 
 	// Update username and repository
 	source.Username = "AWS"
+	source.ecrClient = client
 
 	if source.AwsAccountId != "" {
 		source.Repository = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s", source.AwsAccountId, source.AwsRegion, source.Repository)
@@ -482,9 +745,46 @@ func (tag Tag) String() string {
 	return string(tag)
 }
 
+// Duration is a time.Duration configured as a string, e.g. "72h".
+type Duration time.Duration
+
+// UnmarshalJSON parses the string with time.ParseDuration.
+func (duration *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("parse duration: %w", err)
+	}
+
+	*duration = Duration(d)
+
+	return nil
+}
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(duration.String())
+}
+
+func (duration Duration) String() string {
+	return time.Duration(duration).String()
+}
+
 type Version struct {
 	Tag    string `json:"tag"`
 	Digest string `json:"digest"`
+
+	// Repository is only set when checking multiple repositories, and
+	// records which one the version was found in.
+	Repository string `json:"repository,omitempty"`
+
+	// BaseDigest is only set when tracking the base image, and records the
+	// digest which the base image's tag pointed to.
+	BaseDigest string `json:"base_digest,omitempty"`
 }
 
 type MetadataField struct {
@@ -495,8 +795,37 @@ type MetadataField struct {
 type GetParams struct {
 	RawFormat    string `json:"format"`
 	SkipDownload bool   `json:"skip_download"`
+
+	// What to do when extended attributes from the image can't be set on
+	// the rootfs: one of XattrsSkip, XattrsWarn or XattrsFail.
+	RawXattrs string `json:"xattrs"`
+
+	// Glob patterns of the paths to extract into the rootfs, and of those
+	// not to.
+	IncludePaths []string `json:"include_paths"`
+	ExcludePaths []string `json:"exclude_paths"`
+
+	// Paths to copy out of the image in the files format.
+	Extract []ExtractPath `json:"extract"`
+
+	// Platforms to fetch, e.g. linux/arm64/v8, each into its own directory
+	// rather than fetching only the source's platform.
+	Platforms []string `json:"platforms"`
 }
 
+// ExtractPath is a file or directory in an image, and where to write it
+// relative to the get step's output.
+type ExtractPath struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
+}
+
+const (
+	XattrsSkip = "skip"
+	XattrsWarn = "warn"
+	XattrsFail = "fail"
+)
+
 func (p GetParams) Format() string {
 	if p.RawFormat == "" {
 		return "rootfs"
@@ -505,6 +834,32 @@ func (p GetParams) Format() string {
 	return p.RawFormat
 }
 
+func (p GetParams) ParsePlatforms() ([]v1.Platform, error) {
+	var platforms []v1.Platform
+	for _, raw := range p.Platforms {
+		platform, err := v1.ParsePlatform(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse platform %q: %w", raw, err)
+		}
+
+		if platform.OS == "" || platform.Architecture == "" {
+			return nil, fmt.Errorf("platform %q must have an OS and architecture, e.g. linux/amd64", raw)
+		}
+
+		platforms = append(platforms, *platform)
+	}
+
+	return platforms, nil
+}
+
+func (p GetParams) Xattrs() string {
+	if p.RawXattrs == "" {
+		return XattrsWarn
+	}
+
+	return p.RawXattrs
+}
+
 type PutParams struct {
 	// Path to an OCI image tarball to push.
 	Image string `json:"image"`
@@ -527,6 +882,9 @@ type PutParams struct {
 
 	// Path to a file containing line-separated tags to push.
 	AdditionalTags string `json:"additional_tags"`
+
+	// Create the ECR repository with these settings if it doesn't exist.
+	ECRCreateRepository *ECRRepositorySettings `json:"ecr_create_repository,omitempty"`
 }
 
 func (p *PutParams) ParseAdditionalTags(src string) ([]string, error) {
@@ -543,3 +901,18 @@ func (p *PutParams) ParseAdditionalTags(src string) ([]string, error) {
 
 	return strings.Fields(string(content)), nil
 }
+
+func (p *PutParams) ParseLifecyclePolicy(src string) (string, error) {
+	if p.ECRCreateRepository == nil || p.ECRCreateRepository.LifecyclePolicy == "" {
+		return "", nil
+	}
+
+	filepath := filepath.Join(src, p.ECRCreateRepository.LifecyclePolicy)
+
+	content, err := os.ReadFile(filepath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file at %q: %s", filepath, err)
+	}
+
+	return string(content), nil
+}
@@ -3,6 +3,7 @@ package resource_test
 import (
 	"encoding/json"
 	"runtime"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -47,6 +48,24 @@ var _ = Describe("Source", func() {
 		Expect(json).To(MatchJSON(`{"repository":"foo","insecure":false,"tag":"0"}`))
 	})
 
+	It("should unmarshal durations from strings", func() {
+		var source resource.Source
+		raw := []byte(`{ "min_age": "72h", "max_age": "1h30m" }`)
+
+		err := json.Unmarshal(raw, &source)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Duration(source.MinAge)).To(Equal(72 * time.Hour))
+		Expect(time.Duration(source.MaxAge)).To(Equal(90 * time.Minute))
+	})
+
+	It("should reject invalid durations", func() {
+		var source resource.Source
+		raw := []byte(`{ "min_age": "3 days" }`)
+
+		err := json.Unmarshal(raw, &source)
+		Expect(err).To(HaveOccurred())
+	})
+
 	Describe("platform", func() {
 		It("should set platform to default if not specified", func() {
 			source := resource.Source{